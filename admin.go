@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	DefaultAdminSocket = "/tmp/amipiborg.sock"
+
+	// How long an admin client may take, and how long a command may wait
+	// for the server.
+	AdminTimeout = 10 * time.Second
+)
+
+// The admin socket takes one command per connection, a line of words, and
+// answers with text. Failures are answered with a line starting "error:".
+//
+//	connections      list connections with their handler and age
+//	kill <conn>      close a connection, telling the Amiga it is gone
+//	volumes          list the volumes of every FS connection
+//	rescan           look for mounted volumes again, then list them
+type adminRequest struct {
+	args  []string
+	reply chan adminReply
+}
+
+type adminReply struct {
+	text string
+	err  error
+
+	// Handlers to pass the command on to, outside the server goroutine.
+	targets []adminTarget
+}
+
+// adminTarget is a connection whose handler answers admin commands.
+type adminTarget struct {
+	connId  uint16
+	name    string
+	handler AdminHandler
+}
+
+// Admin runs an admin command in the server goroutine. Commands for the
+// handlers are run by the caller, a handler that is busy must not hold up
+// the server.
+func (this *Server) Admin(args []string) (text string, err error) {
+
+	req := &adminRequest{
+		args:  args,
+		reply: make(chan adminReply, 1)}
+
+	select {
+	case this.adminChan <- req:
+	case <-time.After(AdminTimeout):
+		return "", fmt.Errorf("server not responding")
+	}
+
+	r := <-req.reply
+	if r.err == nil && r.targets != nil {
+		return adminHandlers(args[0], r.targets)
+	}
+
+	return r.text, r.err
+}
+
+func (this *Server) handleAdmin(args []string) adminReply {
+
+	if len(args) == 0 {
+		return adminReply{err: fmt.Errorf("no command")}
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+
+	var err error
+	switch args[0] {
+	case "connections":
+		this.adminConnections(tw)
+	case "kill":
+		err = this.adminKill(tw, args[1:])
+	case "volumes", "rescan":
+		return adminReply{targets: this.adminTargets()}
+	default:
+		err = fmt.Errorf("unknown command \"%s\", try connections, kill, volumes or rescan", args[0])
+	}
+
+	tw.Flush()
+
+	return adminReply{text: buf.String(), err: err}
+}
+
+func (this *Server) sortedConnections() []*Connection {
+
+	conns := make([]*Connection, 0, len(this.connections))
+	for _, c := range this.connections {
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].connId < conns[j].connId })
+
+	return conns
+}
+
+func (this *Server) adminConnections(w io.Writer) {
+
+	fmt.Fprintf(w, "CONN\tHANDLER\tAGE\tIN\tOUT\n")
+	for _, c := range this.sortedConnections() {
+		age := time.Since(c.created).Round(time.Second)
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\n", c.connId, c.info.Name, age, len(c.inChan), len(c.handlerChan)+len(c.outChan))
+	}
+}
+
+func (this *Server) adminKill(w io.Writer, args []string) (err error) {
+
+	if len(args) != 1 {
+		return fmt.Errorf("usage: kill <conn>")
+	}
+
+	id, err := strconv.ParseUint(args[0], 10, 16)
+	if err != nil || id == DEFAULT_CONNECTION {
+		return fmt.Errorf("bad connection id \"%s\"", args[0])
+	}
+
+	cnn := this.GetConnection(uint16(id))
+	if cnn == nil {
+		return fmt.Errorf("no connection %d", id)
+	}
+
+	this.log.Info("Killing connection", "conn", cnn.connId)
+	this.disconnect(cnn)
+
+	fmt.Fprintf(w, "closed connection %d\n", id)
+
+	return nil
+}
+
+// adminTargets lists the connections whose handlers answer admin commands.
+func (this *Server) adminTargets() []adminTarget {
+
+	targets := []adminTarget{}
+	for _, c := range this.sortedConnections() {
+		if ah, ok := c.handler.(AdminHandler); ok {
+			targets = append(targets, adminTarget{c.connId, c.info.Name, ah})
+		}
+	}
+
+	return targets
+}
+
+// adminHandlers passes a command to every handler that knows it.
+func adminHandlers(cmd string, targets []adminTarget) (text string, err error) {
+
+	buf := new(bytes.Buffer)
+	tw := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+
+	handled := false
+	for _, t := range targets {
+		out := new(bytes.Buffer)
+		if t.handler.AdminCommand(cmd, out) {
+			fmt.Fprintf(tw, "connection %d (%s):\n", t.connId, t.name)
+			out.WriteTo(tw)
+			handled = true
+		}
+	}
+
+	tw.Flush()
+
+	if !handled {
+		return "", fmt.Errorf("no connection answers \"%s\"", cmd)
+	}
+
+	return buf.String(), nil
+}
+
+// StartAdminServer listens for admin commands on a Unix socket at path.
+// Only the owner may use the socket.
+func StartAdminServer(path string, srv *Server) (err error) {
+
+	// A socket left behind by an earlier run would stop us listening.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+
+	log := subsystemLogger("admin")
+	log.Info("Admin socket open", "path", path)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Error("Admin socket closed", "err", err)
+				return
+			}
+			go serveAdmin(conn, srv)
+		}
+	}()
+
+	return nil
+}
+
+func serveAdmin(conn net.Conn, srv *Server) {
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(AdminTimeout))
+
+	line, err := bufio.NewReader(io.LimitReader(conn, 1024)).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+
+	text, err := srv.Admin(strings.Fields(line))
+	io.WriteString(conn, text)
+	if err != nil {
+		fmt.Fprintf(conn, "error: %s\n", err.Error())
+	}
+}
+
+// AdminMain is the amipiborg admin command, it sends one command to the
+// admin socket of a running server.
+func AdminMain(args []string) int {
+
+	fl := flag.NewFlagSet("amipiborg admin", flag.ContinueOnError)
+	socket := fl.String("socket", DefaultAdminSocket, "admin socket of the server")
+	fl.Usage = func() {
+		fmt.Fprintf(fl.Output(), "usage: amipiborg admin [-socket path] connections | kill <conn> | volumes | rescan\n")
+		fl.PrintDefaults()
+	}
+
+	if err := fl.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	if fl.NArg() == 0 {
+		fl.Usage()
+		return 2
+	}
+
+	conn, err := net.DialTimeout("unix", *socket, AdminTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(AdminTimeout))
+
+	if _, err = fmt.Fprintf(conn, "%s\n", strings.Join(fl.Args(), " ")); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	reply, err := io.ReadAll(conn)
+	os.Stdout.Write(reply)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	if bytes.HasPrefix(reply, []byte("error: ")) || bytes.Contains(reply, []byte("\nerror: ")) {
+		return 1
+	}
+
+	return 0
+}
@@ -15,7 +15,7 @@ func NewBufferPool(capacity int) (bp *BufferPool) {
 func (this *BufferPool) AllocBuffer() (b []byte) {
 	select {
 	case b = <-this.pool:
-		b = b[:0]
+		b = b[:cap(b)]
 	default:
 		b = make([]byte, 100)
 	}
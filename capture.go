@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Capture files start with CAPTURE_MAGIC and a version, followed by one
+// record per packet:
+//
+//	uint8  direction, CD_In or CD_Out
+//	int64  time in nanoseconds since 1970
+//	uint32 length
+//	       the packet as it was on the wire, header to CRC
+const (
+	CAPTURE_MAGIC   = "AmPiCap\x00"
+	CAPTURE_VERSION = 1
+)
+
+const (
+	CD_In  = 0 // Amiga to Pi
+	CD_Out = 1 // Pi to Amiga
+)
+
+type CaptureRecord struct {
+	Direction uint8
+	Time      time.Time
+	Data      []byte
+}
+
+// Capture records packets to a file. Both the reader and the writer side
+// of the server record into the same capture.
+type Capture struct {
+	file   *os.File
+	lock   sync.Mutex
+	failed bool
+	log    *slog.Logger
+}
+
+func CreateCapture(path string) (c *Capture, err error) {
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(CAPTURE_MAGIC)
+	binary.Write(buf, binary.BigEndian, uint16(CAPTURE_VERSION))
+
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	c = &Capture{
+		file: f,
+		log:  subsystemLogger("framer").With("capture", path)}
+
+	return c, nil
+}
+
+// Record appends a packet to the capture. A capture that can't be written
+// is given up on rather than failing the server.
+func (this *Capture) Record(direction uint8, data []byte) {
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, direction)
+	binary.Write(buf, binary.BigEndian, time.Now().UnixNano())
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.failed {
+		return
+	}
+
+	if _, err := this.file.Write(buf.Bytes()); err != nil {
+		this.log.Error("Capture stopped", "err", err)
+		this.failed = true
+	}
+}
+
+func (this *Capture) Close() (err error) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.failed = true
+
+	return this.file.Close()
+}
+
+// CaptureReader reads back the records of a capture file.
+type CaptureReader struct {
+	file *os.File
+	r    *bufio.Reader
+}
+
+func OpenCapture(path string) (cr *CaptureReader, err error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cr = &CaptureReader{
+		file: f,
+		r:    bufio.NewReader(f)}
+
+	header := make([]byte, len(CAPTURE_MAGIC)+2)
+	if _, err = io.ReadFull(cr.r, header); err != nil || string(header[:len(CAPTURE_MAGIC)]) != CAPTURE_MAGIC {
+		f.Close()
+		return nil, fmt.Errorf("%s: not a capture file", path)
+	}
+
+	version := binary.BigEndian.Uint16(header[len(CAPTURE_MAGIC):])
+	if version != CAPTURE_VERSION {
+		f.Close()
+		return nil, fmt.Errorf("%s: unsupported capture version %d", path, version)
+	}
+
+	return cr, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the capture.
+func (this *CaptureReader) Next() (rec CaptureRecord, err error) {
+
+	head := make([]byte, 13)
+	if _, err = io.ReadFull(this.r, head); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("truncated capture record")
+		}
+		return rec, err
+	}
+
+	rec.Direction = head[0]
+	rec.Time = time.Unix(0, int64(binary.BigEndian.Uint64(head[1:])))
+
+	length := binary.BigEndian.Uint32(head[9:])
+	if length > HEADER_LENGTH+MAX_PACKET_LENGTH+1+CRC_LENGTH {
+		return rec, fmt.Errorf("bad capture record length %d", length)
+	}
+
+	rec.Data = make([]byte, length)
+	if _, err = io.ReadFull(this.r, rec.Data); err != nil {
+		return rec, fmt.Errorf("truncated capture record")
+	}
+
+	return rec, nil
+}
+
+func (this *CaptureReader) Close() {
+	this.file.Close()
+}
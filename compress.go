@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+)
+
+// MT_Data payloads flagged PF_Compressed are LZSS compressed, simple enough
+// to unpack quickly on a 68000. The data is a run of groups, each a flag
+// byte followed by up to eight items, the most significant bit first:
+//
+//	0 a literal byte
+//	1 a uint16 match, (offset-1)<<4 | (length-LZSS_MIN_MATCH), copying
+//	  length bytes starting offset bytes back in the output
+//
+// The data simply ends after the last item, unused flag bits are zero.
+const (
+	LZSS_WINDOW    = 4096
+	LZSS_MIN_MATCH = 3
+	LZSS_MAX_MATCH = LZSS_MIN_MATCH + 15
+
+	// How many earlier positions with the same hash to try for a match.
+	lzssMaxChain = 64
+	lzssHashBits = 12
+)
+
+func lzssHash(b []byte) int {
+	return int((uint32(b[0])<<8^uint32(b[1])<<4^uint32(b[2]))*2654435761>>(32-lzssHashBits)) & (1<<lzssHashBits - 1)
+}
+
+// lzssCompress compresses src. The result can be longer than src, callers
+// should send whichever is shorter.
+func lzssCompress(src []byte) []byte {
+
+	dst := make([]byte, 0, len(src)+len(src)/8+1)
+
+	head := make([]int, 1<<lzssHashBits)
+	for ix := range head {
+		head[ix] = -1
+	}
+	prev := make([]int, len(src))
+
+	insert := func(pos int) {
+		if pos+LZSS_MIN_MATCH <= len(src) {
+			h := lzssHash(src[pos:])
+			prev[pos] = head[h]
+			head[h] = pos
+		}
+	}
+
+	flagPos := -1
+	bit := 8
+
+	for pos := 0; pos < len(src); {
+
+		if bit == 8 {
+			flagPos = len(dst)
+			dst = append(dst, 0)
+			bit = 0
+		}
+
+		bestLen, bestOff := 0, 0
+		if pos+LZSS_MIN_MATCH <= len(src) {
+			maxLen := len(src) - pos
+			if maxLen > LZSS_MAX_MATCH {
+				maxLen = LZSS_MAX_MATCH
+			}
+
+			cand := head[lzssHash(src[pos:])]
+			for chain := 0; cand >= 0 && pos-cand <= LZSS_WINDOW && chain < lzssMaxChain; chain++ {
+				l := 0
+				for l < maxLen && src[cand+l] == src[pos+l] {
+					l++
+				}
+				if l > bestLen {
+					bestLen, bestOff = l, pos-cand
+					if l == maxLen {
+						break
+					}
+				}
+				cand = prev[cand]
+			}
+		}
+
+		if bestLen >= LZSS_MIN_MATCH {
+			dst[flagPos] |= 0x80 >> bit
+			code := uint16(bestOff-1)<<4 | uint16(bestLen-LZSS_MIN_MATCH)
+			dst = append(dst, byte(code>>8), byte(code))
+			for end := pos + bestLen; pos < end; pos++ {
+				insert(pos)
+			}
+		} else {
+			dst = append(dst, src[pos])
+			insert(pos)
+			pos++
+		}
+		bit++
+	}
+
+	return dst
+}
+
+// lzssDecompress undoes lzssCompress, refusing to produce more than max
+// bytes.
+func lzssDecompress(src []byte, max int) (dst []byte, err error) {
+
+	dst = make([]byte, 0, max)
+
+	for ix := 0; ix < len(src); {
+
+		flags := src[ix]
+		ix++
+
+		for bit := 0; bit < 8 && ix < len(src); bit++ {
+
+			if flags&(0x80>>bit) == 0 {
+				if len(dst) >= max {
+					return nil, fmt.Errorf("decompressed data longer than %d bytes", max)
+				}
+				dst = append(dst, src[ix])
+				ix++
+				continue
+			}
+
+			if ix+2 > len(src) {
+				return nil, fmt.Errorf("truncated match")
+			}
+			code := uint16(src[ix])<<8 | uint16(src[ix+1])
+			ix += 2
+
+			offset := int(code>>4) + 1
+			length := int(code&0xf) + LZSS_MIN_MATCH
+
+			if offset > len(dst) {
+				return nil, fmt.Errorf("match offset %d before start of data", offset)
+			}
+			if len(dst)+length > max {
+				return nil, fmt.Errorf("decompressed data longer than %d bytes", max)
+			}
+
+			// Byte by byte, a match may overlap what it produces.
+			from := len(dst) - offset
+			for n := 0; n < length; n++ {
+				dst = append(dst, dst[from+n])
+			}
+		}
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestLZSSRoundTrip(t *testing.T) {
+
+	noise := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(noise)
+
+	for _, data := range [][]byte{
+		{},
+		{1},
+		{1, 2},
+		[]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"),
+		[]byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 90)),
+		noise,
+		make([]byte, 4096)} {
+
+		packed := lzssCompress(data)
+		plain, err := lzssDecompress(packed, len(data))
+		if err != nil {
+			t.Fatalf("%d bytes: %s", len(data), err)
+		}
+		if !bytes.Equal(plain, data) {
+			t.Fatalf("%d bytes came back different", len(data))
+		}
+	}
+}
+
+func TestLZSSBadInput(t *testing.T) {
+
+	if _, err := lzssDecompress(lzssCompress(make([]byte, 4096)), 100); err == nil {
+		t.Error("decompressed past the limit")
+	}
+
+	// A match before the start of the data.
+	if _, err := lzssDecompress([]byte{0x80, 0, 0}, 100); err == nil {
+		t.Error("bad offset accepted")
+	}
+}
+
+func TestCompressedLink(t *testing.T) {
+
+	_, amiga := startServer(t, nil)
+	amiga.Compress = true
+	amiga.CRC = true
+	amiga.WindowSize = 4
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if !amiga.session.has(CAP_Compress) {
+		t.Fatal("compression not agreed")
+	}
+	if err := amiga.Connect(3, HT_Ping); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte(strings.Repeat("ping ping ping ", 40))
+	amiga.Send(3, msg)
+
+	p, err := amiga.Expect(3, MT_Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.Data, msg) {
+		t.Fatalf("%d bytes came back as %d", len(msg), len(p.Data))
+	}
+}
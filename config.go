@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	RT_Serial = "serial"
+	RT_TCP    = "tcp"
+	RT_Replay = "replay"
+)
+
+const (
+	SP_None = "none"
+	SP_Odd  = "odd"
+	SP_Even = "even"
+)
+
+const (
+	FC_None   = "none"
+	FC_RTSCTS = "rtscts"
+)
+
+type RemoteConfig struct {
+	Type    string `json:"type"`
+	Device  string `json:"device"`
+	Baud    int    `json:"baud"`
+	Address string `json:"address"`
+
+	// Serial line settings, 8N1 without flow control by default.
+	DataBits int    `json:"dataBits"`
+	Parity   string `json:"parity"`
+	StopBits int    `json:"stopBits"`
+	Flow     string `json:"flow"`
+
+	// Capture to play back with RT_Replay.
+	Replay string `json:"replay"`
+}
+
+type FsConfig struct {
+	DefaultName string `json:"defaultName"`
+	DefaultPath string `json:"defaultPath"`
+	MountPath   string `json:"mountPath"`
+}
+
+type Config struct {
+	Remote RemoteConfig `json:"remote"`
+	Fs     FsConfig     `json:"fs"`
+	Log    LogConfig    `json:"log"`
+
+	// File to record every packet to, for amipiborg-dump.
+	Capture string `json:"capture"`
+
+	// Address to serve /metrics on. Empty turns metrics off.
+	Metrics string `json:"metrics"`
+
+	// Unix socket for amipiborg admin. Empty turns it off.
+	Admin string `json:"admin"`
+
+	// Sent packets kept for the Amiga to ask for again.
+	RetransmitDepth int `json:"retransmitDepth"`
+
+	// Seconds of silence before the Amiga is pinged, 0 never pings, and
+	// unanswered pings before its session is dropped.
+	KeepaliveInterval int `json:"keepaliveInterval"`
+	KeepaliveMisses   int `json:"keepaliveMisses"`
+
+	// Names of the handlers to offer the Amiga. Empty means all of them.
+	Handlers []string `json:"handlers"`
+}
+
+func DefaultConfig() *Config {
+
+	return &Config{
+		Remote: RemoteConfig{
+			Type:     RT_Serial,
+			Device:   "/dev/ttyUSB0",
+			Baud:     19200,
+			Address:  ":6502",
+			DataBits: 8,
+			Parity:   SP_None,
+			StopBits: 1,
+			Flow:     FC_None},
+		Fs: FsConfig{
+			DefaultName: "AmiPiBorg",
+			DefaultPath: "/home/pi",
+			MountPath:   "/media/pi"},
+		Log: LogConfig{
+			Level:  "info",
+			Format: LF_Text},
+		RetransmitDepth:   DefaultRetransmitDepth,
+		KeepaliveInterval: int(DefaultKeepaliveInterval / time.Second),
+		KeepaliveMisses:   DefaultKeepaliveMisses,
+		Handlers:          nil}
+}
+
+// LoadConfig reads a JSON config file over the defaults. Settings missing
+// from the file keep their default values.
+func LoadConfig(path string) (cfg *Config, err error) {
+
+	cfg = DefaultConfig()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	return cfg, nil
+}
+
+// ParseConfig builds the configuration from the command line. A file named
+// by -config is loaded first and any other flags given override it.
+func ParseConfig(args []string) (cfg *Config, err error) {
+
+	fl := flag.NewFlagSet("amipiborg", flag.ContinueOnError)
+
+	def := DefaultConfig()
+
+	configPath := fl.String("config", "", "JSON configuration file")
+	remoteType := fl.String("remote", def.Remote.Type, "remote type, \"serial\", \"tcp\" or \"replay\"")
+	device := fl.String("device", def.Remote.Device, "serial device")
+	baud := fl.Int("baud", def.Remote.Baud, "serial baud rate")
+	dataBits := fl.Int("data-bits", def.Remote.DataBits, "serial data bits, 5 to 8")
+	parity := fl.String("parity", def.Remote.Parity, "serial parity, \"none\", \"odd\" or \"even\"")
+	stopBits := fl.Int("stop-bits", def.Remote.StopBits, "serial stop bits, 1 or 2")
+	flow := fl.String("flow", def.Remote.Flow, "serial flow control, \"none\" or \"rtscts\"")
+	tcpAddr := fl.String("tcp", "", "listen for the Amiga on this TCP address instead of the serial port")
+	fsName := fl.String("fs-name", def.Fs.DefaultName, "name of the default volume")
+	fsPath := fl.String("fs-path", def.Fs.DefaultPath, "directory shared as the default volume")
+	mountPath := fl.String("mount-path", def.Fs.MountPath, "directory where removable media is mounted")
+	replay := fl.String("replay", "", "play the Amiga side of a capture file and compare the replies")
+	handlers := fl.String("handlers", "", "comma separated list of handlers to enable")
+	logLevel := fl.String("log-level", def.Log.Level, "log level, \"debug\", \"info\", \"warn\" or \"error\"")
+	logFormat := fl.String("log-format", def.Log.Format, "log format, \"text\", \"json\" or \"journald\"")
+	capture := fl.String("capture", "", "record every packet to this file")
+	metrics := fl.String("metrics", "", "serve metrics on this address, e.g. \"localhost:9102\"")
+	retransmitDepth := fl.Int("retransmit-depth", def.RetransmitDepth, "sent packets kept for the Amiga to ask for again")
+	keepalive := fl.Int("keepalive", def.KeepaliveInterval, "seconds of silence before pinging the Amiga, 0 to never ping")
+	keepaliveMisses := fl.Int("keepalive-misses", def.KeepaliveMisses, "unanswered pings before the Amiga's session is dropped")
+	admin := fl.String("admin", "", "listen for admin commands on this Unix socket, e.g. \""+DefaultAdminSocket+"\"")
+
+	if err = fl.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configPath != "" {
+		if cfg, err = LoadConfig(*configPath); err != nil {
+			return nil, err
+		}
+	} else {
+		cfg = def
+	}
+
+	fl.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "remote":
+			cfg.Remote.Type = *remoteType
+		case "device":
+			cfg.Remote.Device = *device
+		case "baud":
+			cfg.Remote.Baud = *baud
+		case "data-bits":
+			cfg.Remote.DataBits = *dataBits
+		case "parity":
+			cfg.Remote.Parity = *parity
+		case "stop-bits":
+			cfg.Remote.StopBits = *stopBits
+		case "flow":
+			cfg.Remote.Flow = *flow
+		case "tcp":
+			cfg.Remote.Type = RT_TCP
+			cfg.Remote.Address = *tcpAddr
+		case "replay":
+			cfg.Remote.Type = RT_Replay
+			cfg.Remote.Replay = *replay
+		case "fs-name":
+			cfg.Fs.DefaultName = *fsName
+		case "fs-path":
+			cfg.Fs.DefaultPath = *fsPath
+		case "mount-path":
+			cfg.Fs.MountPath = *mountPath
+		case "handlers":
+			cfg.Handlers = strings.Split(*handlers, ",")
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "log-format":
+			cfg.Log.Format = *logFormat
+		case "capture":
+			cfg.Capture = *capture
+		case "metrics":
+			cfg.Metrics = *metrics
+		case "admin":
+			cfg.Admin = *admin
+		case "retransmit-depth":
+			cfg.RetransmitDepth = *retransmitDepth
+		case "keepalive":
+			cfg.KeepaliveInterval = *keepalive
+		case "keepalive-misses":
+			cfg.KeepaliveMisses = *keepaliveMisses
+		}
+	})
+
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (this *Config) Validate() (err error) {
+
+	switch this.Remote.Type {
+	case RT_Serial:
+		if this.Remote.Device == "" {
+			return fmt.Errorf("no serial device given")
+		}
+		if this.Remote.Baud <= 0 {
+			return fmt.Errorf("invalid baud rate %d", this.Remote.Baud)
+		}
+		if this.Remote.DataBits < 5 || this.Remote.DataBits > 8 {
+			return fmt.Errorf("invalid data bits %d", this.Remote.DataBits)
+		}
+		switch this.Remote.Parity {
+		case SP_None, SP_Odd, SP_Even:
+		default:
+			return fmt.Errorf("unknown parity \"%s\"", this.Remote.Parity)
+		}
+		if this.Remote.StopBits != 1 && this.Remote.StopBits != 2 {
+			return fmt.Errorf("invalid stop bits %d", this.Remote.StopBits)
+		}
+		switch this.Remote.Flow {
+		case FC_None, FC_RTSCTS:
+		default:
+			return fmt.Errorf("unknown flow control \"%s\"", this.Remote.Flow)
+		}
+	case RT_TCP:
+		if this.Remote.Address == "" {
+			return fmt.Errorf("no TCP address given")
+		}
+	case RT_Replay:
+		if this.Remote.Replay == "" {
+			return fmt.Errorf("no capture given to replay")
+		}
+	default:
+		return fmt.Errorf("unknown remote type \"%s\"", this.Remote.Type)
+	}
+
+	if this.RetransmitDepth < MaxWindowSize || this.RetransmitDepth > MaxRetransmitDepth {
+		return fmt.Errorf("retransmit depth must be between %d and %d", MaxWindowSize, MaxRetransmitDepth)
+	}
+
+	for _, h := range this.Handlers {
+		if !knownHandler(h) {
+			return fmt.Errorf("unknown handler \"%s\", choose from %s", h, strings.Join(handlerNames, ", "))
+		}
+	}
+
+	if this.KeepaliveInterval < 0 {
+		return fmt.Errorf("invalid keepalive interval %d", this.KeepaliveInterval)
+	}
+	if this.KeepaliveMisses < 1 {
+		return fmt.Errorf("keepalive misses must be at least 1")
+	}
+
+	if _, err = parseLevel(this.Log.Level); err != nil {
+		return err
+	}
+
+	switch this.Log.Format {
+	case "", LF_Text, LF_JSON, LF_Journald:
+	default:
+		return fmt.Errorf("unknown log format \"%s\"", this.Log.Format)
+	}
+
+	return nil
+}
+
+// HandlerEnabled reports whether the named handler should be offered.
+func (this *Config) HandlerEnabled(name string) bool {
+
+	if len(this.Handlers) == 0 {
+		return true
+	}
+
+	for _, h := range this.Handlers {
+		if strings.EqualFold(strings.TrimSpace(h), name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func knownHandler(name string) bool {
+
+	for _, n := range handlerNames {
+		if strings.EqualFold(strings.TrimSpace(name), n) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (this *Config) CreateRemote() (r Remote, err error) {
+
+	switch this.Remote.Type {
+	case RT_TCP:
+		return NewTCPRemote(this.Remote.Address)
+	case RT_Replay:
+		return NewReplayRemote(this.Remote.Replay)
+	default:
+		return NewSerialRemote(this.Remote)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHandlerNames(t *testing.T) {
+
+	cfg, err := ParseConfig([]string{"-handlers", "ping, fs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.HandlerEnabled(HN_Ping) || !cfg.HandlerEnabled(HN_FS) || cfg.HandlerEnabled(HN_Input) {
+		t.Fatalf("wrong handlers enabled for %v", cfg.Handlers)
+	}
+
+	for _, handlers := range []string{"INPT", "PING,INPT", ""} {
+		if _, err = ParseConfig([]string{"-handlers", handlers}); err == nil {
+			t.Errorf("-handlers %q accepted", handlers)
+		}
+	}
+}
+
+func TestLineSettings(t *testing.T) {
+
+	tests := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{}, true},
+		{[]string{"-baud", "9600", "-data-bits", "7", "-parity", "even", "-stop-bits", "2"}, true},
+		{[]string{"-data-bits", "5", "-parity", "odd"}, true},
+		{[]string{"-flow", "rtscts"}, true},
+		{[]string{"-baud", "0"}, false},
+		{[]string{"-baud", "-9600"}, false},
+		{[]string{"-data-bits", "4"}, false},
+		{[]string{"-data-bits", "9"}, false},
+		{[]string{"-parity", "mark"}, false},
+		{[]string{"-parity", "Even"}, false},
+		{[]string{"-stop-bits", "0"}, false},
+		{[]string{"-stop-bits", "3"}, false},
+		{[]string{"-flow", "xonxoff"}, false},
+		{[]string{"-flow", ""}, false},
+		// Only checked for the serial remote.
+		{[]string{"-tcp", ":6502", "-data-bits", "9", "-flow", "xonxoff"}, true}}
+
+	for _, test := range tests {
+		if _, err := ParseConfig(test.args); (err == nil) != test.ok {
+			t.Errorf("%v: err %v", test.args, err)
+		}
+	}
+
+	cfg, err := ParseConfig([]string{"-baud", "9600", "-data-bits", "7", "-parity", "even", "-stop-bits", "2", "-flow", "rtscts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RemoteConfig{
+		Type:     RT_Serial,
+		Device:   "/dev/ttyUSB0",
+		Baud:     9600,
+		Address:  ":6502",
+		DataBits: 7,
+		Parity:   SP_Even,
+		StopBits: 2,
+		Flow:     FC_RTSCTS}
+	if cfg.Remote != want {
+		t.Fatalf("got %+v, want %+v", cfg.Remote, want)
+	}
+}
@@ -1,30 +1,94 @@
 package main
 
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	// Packets a connection may have queued or unacknowledged at the server.
+	ConnectionCredits = 4
+
+	// Bytes of a connection's packets a queueing remote may hold before
+	// they are on the line. Acks don't help here, without an ack window a
+	// busy connection would fill the remote's queue and everything else
+	// would wait behind it.
+	ConnectionUnwrittenBytes = 1024
+)
+
 type Connection struct {
 	connId      uint16
-	handler     Handler
+	info        HandlerInfo
+	created     time.Time
+	handler     ContextHandler
+	priority    bool
 	inChan      chan *InPacket
 	outChan     chan *OutPacket
 	handlerChan chan *OutPacket
 	ctrlChan    chan bool
+	doneChan    chan bool
+	wakeChan    chan bool
+	log         *slog.Logger
+	handlerLog  *slog.Logger
+
+	// Whether the Amiga takes fragmented messages.
+	fragments bool
+
+	// Only touched by the server goroutine.
+	inFlight   int
+	unwritten  int
+	reassembly *reassembly
 }
 
-func NewConnection(connId uint16, h Handler, outChan chan *OutPacket) (cnn *Connection) {
+// HandlerConn is a handler's view of its connection.
+type HandlerConn struct {
+	connId  uint16
+	ctx     context.Context
+	inChan  chan *InPacket
+	outChan chan *OutPacket
+	log     *slog.Logger
+}
+
+func NewConnection(connId uint16, info HandlerInfo, h ContextHandler, wakeChan chan bool) (cnn *Connection) {
 
 	cnn = &Connection{
 		connId:      connId,
+		info:        info,
+		created:     time.Now(),
 		handler:     h,
+		priority:    info.Flags&HF_Interactive != 0,
 		inChan:      make(chan *InPacket, 100),
-		outChan:     outChan,
+		outChan:     make(chan *OutPacket, ConnectionCredits),
 		handlerChan: make(chan *OutPacket, 1000),
-		ctrlChan:    make(chan bool)}
-
-	h.Init(cnn.handlerChan)
+		ctrlChan:    make(chan bool),
+		doneChan:    make(chan bool),
+		wakeChan:    wakeChan,
+		log:         subsystemLogger("server").With("conn", connId),
+		handlerLog:  subsystemLogger(strings.ToLower(info.Name)).With("conn", connId),
+		inFlight:    0,
+		reassembly:  newReassembly()}
 
 	return cnn
 }
 
+// HandlePacket passes a packet to the handler, fragments only once the
+// whole message is in.
 func (this *Connection) HandlePacket(p *InPacket) {
+
+	if p.PacketType == MT_Data && p.Flags&PF_Fragment != 0 {
+		msg, err := this.reassembly.add(p)
+		if err != nil {
+			this.log.Warn("Dropping fragmented message", "err", err)
+		}
+		if msg == nil {
+			return
+		}
+		p = msg
+	}
+
 	this.inChan <- p
 }
 
@@ -32,19 +96,200 @@ func (this *Connection) GetControlChannel() chan bool {
 	return this.ctrlChan
 }
 
+// Close stops the connection and waits for its handler to quit.
+func (this *Connection) Close() {
+	this.ctrlChan <- true
+	<-this.doneChan
+}
+
+// hasCredit reports whether the server may take another packet from the
+// connection.
+func (this *Connection) hasCredit() bool {
+	return this.inFlight < ConnectionCredits && this.unwritten < ConnectionUnwrittenBytes
+}
+
+// nextPacket returns the next queued packet without waiting.
+func (this *Connection) nextPacket() *OutPacket {
+
+	select {
+	case p := <-this.outChan:
+		return p
+	default:
+		return nil
+	}
+}
+
 func (this *Connection) Run() {
 
+	ctx, cancel := context.WithCancel(context.Background())
+
+	conn := &HandlerConn{
+		connId:  this.connId,
+		ctx:     ctx,
+		inChan:  this.inChan,
+		outChan: this.handlerChan,
+		log:     this.handlerLog}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- this.handler.Serve(ctx, conn)
+	}()
+
+	// Packets of one message, held back while the server's queue for us
+	// is full.
+	var pending []*OutPacket
+
 	done := false
 	for !done {
+
+		var hc chan *OutPacket
+		var oc chan *OutPacket
+		var next *OutPacket
+		if len(pending) == 0 {
+			hc = this.handlerChan
+		} else {
+			oc = this.outChan
+			next = pending[0]
+		}
+
+		// Once the handler is finished nobody else reads what the Amiga
+		// sends, it mustn't back up into the server.
+		var ic chan *InPacket
+		if served == nil {
+			ic = this.inChan
+		}
+
 		select {
-		case p := <-this.inChan:
-			this.handler.HandlePacket(p)
-		case p := <-this.handlerChan:
+		case p := <-ic:
+			this.log.Debug("Dropping packet, handler finished", "type", p.PacketType)
+		case p := <-hc:
 			p.ConnId = this.connId
-			this.outChan <- p
+			pending = this.split(p)
+		case oc <- next:
+			pending = pending[1:]
+			select {
+			case this.wakeChan <- true:
+			default:
+			}
+		case err := <-served:
+			// The handler is finished, the connection stays open until
+			// the Amiga closes it.
+			served = nil
+			if err != nil && err != context.Canceled {
+				this.log.Error("Handler failed", "err", err)
+				select {
+				case this.handlerChan <- errorPacket(EC_HandlerFailed, err.Error()):
+				default:
+				}
+			}
 		case done = <-this.ctrlChan:
 		}
 	}
 
-	this.handler.Quit()
+	// Nobody sends the handler's packets any more, but a handler blocked
+	// on a full channel has to get through to see it is cancelled.
+	cancel()
+	for served != nil {
+		select {
+		case <-this.handlerChan:
+		case <-served:
+			served = nil
+		}
+	}
+
+	close(this.doneChan)
+}
+
+// split fragments a message too long for one packet. An Amiga that can't
+// take fragments reads no more than MAX_PACKET_LENGTH at once, like we do. A
+// message that can't be sent at all closes the connection, the handler's
+// data would be missing otherwise.
+func (this *Connection) split(p *OutPacket) []*OutPacket {
+
+	if p.PacketType != MT_Data || len(p.Data) <= MAX_PACKET_LENGTH {
+		return []*OutPacket{p}
+	}
+
+	if !this.fragments {
+		return this.tooLong(p, fmt.Errorf("message of %d bytes needs fragments", len(p.Data)))
+	}
+
+	ops, err := fragment(p)
+	if err != nil {
+		return this.tooLong(p, err)
+	}
+
+	return ops
+}
+
+// tooLong gives up on p, the Amiga is told why if it can be and the
+// connection is closed.
+func (this *Connection) tooLong(p *OutPacket, err error) []*OutPacket {
+
+	this.log.Error("Message too long for the Amiga, closing connection", "length", len(p.Data), "err", err)
+
+	e := errorPacket(EC_MessageTooLong, err.Error())
+	e.ConnId = this.connId
+
+	return []*OutPacket{e, {ConnId: this.connId, PacketType: MT_Disconnected}}
+}
+
+// ConnId returns the id the Amiga gave the connection.
+func (this *HandlerConn) ConnId() uint16 {
+	return this.connId
+}
+
+// Packets delivers data sent by the Amiga.
+func (this *HandlerConn) Packets() <-chan *InPacket {
+	return this.inChan
+}
+
+// Done is closed when the connection is closed.
+func (this *HandlerConn) Done() <-chan struct{} {
+	return this.ctx.Done()
+}
+
+// Send queues data for the Amiga, waiting if the connection is backed up.
+// Data too long for one packet is sent in fragments.
+func (this *HandlerConn) Send(data []byte) (err error) {
+
+	return this.send(&OutPacket{
+		PacketType: MT_Data,
+		Data:       data})
+}
+
+// SendError tells the Amiga a request on this connection failed.
+func (this *HandlerConn) SendError(code uint16, message string) (err error) {
+
+	return this.send(errorPacket(code, message))
+}
+
+func (this *HandlerConn) send(p *OutPacket) (err error) {
+
+	select {
+	case this.outChan <- p:
+		return nil
+	case <-this.ctx.Done():
+		return this.ctx.Err()
+	}
+}
+
+// Logger returns a logger tagged with the handler and connection.
+func (this *HandlerConn) Logger() *slog.Logger {
+	return this.log
+}
+
+func (this *HandlerConn) Logf(format string, args ...interface{}) {
+	this.log.Info(fmt.Sprintf(format, args...))
+}
+
+// errorPacket makes an MT_Error for a connection, the server lays it out
+// for the client when it is sent.
+func errorPacket(code uint16, message string) *OutPacket {
+
+	return &OutPacket{
+		PacketType: MT_Error,
+		Error: &ProtocolError{
+			Code:    code,
+			Message: message}}
 }
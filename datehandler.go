@@ -2,38 +2,40 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
-	"fmt"
 	"time"
 )
 
 type DateHandler struct {
-	outChan chan *OutPacket
 }
 
-func (this *DateHandler) Init(outChan chan *OutPacket) {
-	this.outChan = outChan
+// Sends the time as seconds since the Amiga epoch as soon as the Amiga
+// connects.
+func (this *DateHandler) Serve(ctx context.Context, conn *HandlerConn) error {
 
 	t1 := time.Now().Unix()
 	t2 := time.Date(1978, 1, 1, 0, 0, 0, 0, time.Local).Unix()
 
-	fmt.Printf("Amiga time is %ld\n", t1-t2)
+	conn.Logf("Amiga time is %d", t1-t2)
 
 	buf := new(bytes.Buffer)
 
 	binary.Write(buf, binary.BigEndian, uint32(t1-t2))
 
-	this.outChan <- &OutPacket{
-		PacketType: MT_Data,
-		Data:       buf.Bytes()}
+	if err := conn.Send(buf.Bytes()); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-conn.Packets():
+		case <-ctx.Done():
+			return nil
+		}
+	}
 }
 
-func (this *DateHandler) HandlePacket(p *InPacket) {
-}
-
-func (this *DateHandler) Quit() {
-}
-
-func NewDateHandler() Handler {
+func NewDateHandler() ContextHandler {
 	return &DateHandler{}
 }
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var packetTypeNames = map[uint8]string{
+	MT_Init:         "MT_Init",
+	MT_Hello:        "MT_Hello",
+	MT_Shutdown:     "MT_Shutdown",
+	MT_Goodbye:      "MT_Goodbye",
+	MT_Connect:      "MT_Connect",
+	MT_Connected:    "MT_Connected",
+	MT_Disconnect:   "MT_Disconnect",
+	MT_Disconnected: "MT_Disconnected",
+	MT_Data:         "MT_Data",
+	MT_Ack:          "MT_Ack",
+	MT_Resend:       "MT_Resend",
+	MT_Ping:         "MT_Ping",
+	MT_Pong:         "MT_Pong",
+	MT_Error:        "MT_Error",
+	MT_NoHandler:    "MT_NoHandler",
+	MT_NoConnection: "MT_NoConnection"}
+
+func packetTypeName(t uint8) string {
+
+	if name, ok := packetTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("MT_%#02x", t)
+}
+
+func packetFlagNames(flags uint8) string {
+
+	names := []string{}
+	for _, f := range []struct {
+		flag uint8
+		name string
+	}{{PF_PadByte, "pad"}, {PF_Resend, "resend"}, {PF_CRC32, "crc"}, {PF_Compressed, "lzss"}, {PF_Fragment, "frag"}, {PF_LastFragment, "last"}} {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+			flags &^= f.flag
+		}
+	}
+	if flags != 0 {
+		names = append(names, fmt.Sprintf("%#02x", flags))
+	}
+
+	return strings.Join(names, ",")
+}
+
+// parseRawPacket splits a packet as it was on the wire into its fields,
+// without checking it. It returns nil if there isn't a whole header.
+func parseRawPacket(b []byte) *InPacket {
+
+	if len(b) < HEADER_LENGTH {
+		return nil
+	}
+
+	p := &InPacket{
+		PacketType: b[4],
+		Flags:      b[5],
+		ConnId:     binary.BigEndian.Uint16(b[6:]),
+		PacketId:   binary.BigEndian.Uint16(b[8:]),
+		Length:     binary.BigEndian.Uint16(b[12:])}
+
+	end := HEADER_LENGTH + int(p.Length)
+	if end > len(b) {
+		end = len(b)
+	}
+	p.Data = b[HEADER_LENGTH:end]
+
+	return p
+}
+
+// packetSummary describes the header of a packet in one line.
+func packetSummary(b []byte) string {
+
+	p := parseRawPacket(b)
+	if p == nil {
+		return fmt.Sprintf("short packet, %d bytes", len(b))
+	}
+
+	flags := ""
+	if p.Flags != 0 {
+		flags = " [" + packetFlagNames(p.Flags) + "]"
+	}
+
+	return fmt.Sprintf("conn %d id %d %s%s len %d", p.ConnId, p.PacketId, packetTypeName(p.PacketType), flags, p.Length)
+}
+
+// dissector turns capture records into text. It follows MT_Connect so it
+// knows which connections talk to which handler.
+type dissector struct {
+	out      io.Writer
+	hexDump  bool
+	start    int64
+	handlers map[uint16]uint16
+	pending  map[uint16]uint16
+	version  uint16
+	caps     uint32
+}
+
+func newDissector(out io.Writer, hexDump bool) *dissector {
+
+	return &dissector{
+		out:      out,
+		hexDump:  hexDump,
+		handlers: make(map[uint16]uint16),
+		pending:  make(map[uint16]uint16)}
+}
+
+func (this *dissector) printf(format string, args ...interface{}) {
+	fmt.Fprintf(this.out, format, args...)
+}
+
+func (this *dissector) record(rec CaptureRecord) {
+
+	if this.start == 0 {
+		this.start = rec.Time.UnixNano()
+	}
+
+	dir := "A>P"
+	if rec.Direction == CD_Out {
+		dir = "P>A"
+	}
+
+	elapsed := float64(rec.Time.UnixNano()-this.start) / 1e9
+
+	this.printf("%10.6f %s %s\n", elapsed, dir, packetSummary(rec.Data))
+
+	p := parseRawPacket(rec.Data)
+	if p == nil {
+		return
+	}
+
+	if p.Flags&PF_Compressed != 0 {
+		plain, err := lzssDecompress(p.Data, MAX_PACKET_LENGTH)
+		if err != nil {
+			this.printf("    bad compressed data: %s\n", err.Error())
+			return
+		}
+		this.printf("    %d bytes uncompressed\n", len(plain))
+		p.Data = plain
+	}
+
+	// Only the first fragment starts with a request or reply.
+	first := true
+	if p.Flags&PF_Fragment != 0 && len(p.Data) >= FRAGMENT_HEADER_LENGTH {
+		ix := binary.BigEndian.Uint16(p.Data)
+		this.printf("    fragment %d\n", ix)
+		first = ix == 0
+		p.Data = p.Data[FRAGMENT_HEADER_LENGTH:]
+	}
+
+	if first {
+		if rec.Direction == CD_In {
+			this.fromAmiga(p)
+		} else {
+			this.toAmiga(p)
+		}
+	}
+
+	if this.hexDump && len(p.Data) > 0 {
+		for _, line := range strings.Split(strings.TrimRight(hex.Dump(p.Data), "\n"), "\n") {
+			this.printf("    %s\n", line)
+		}
+	}
+}
+
+func (this *dissector) fromAmiga(p *InPacket) {
+
+	switch p.PacketType {
+	case MT_Init:
+		this.version = 0
+		if ci, err := parseInit(p.Data); err == nil {
+			this.printf("    version %d caps %#x window %d\n", ci.version, ci.caps, ci.window)
+			this.version = ci.version
+		}
+		this.handlers = make(map[uint16]uint16)
+		this.pending = make(map[uint16]uint16)
+		this.caps = 0
+	case MT_Connect:
+		if len(p.Data) >= 2 {
+			id := binary.BigEndian.Uint16(p.Data)
+			this.pending[p.ConnId] = id
+			this.printf("    handler %d\n", id)
+		}
+	case MT_Disconnect:
+		delete(this.handlers, p.ConnId)
+	case MT_Ack, MT_Resend:
+		if len(p.Data) >= 2 {
+			this.printf("    packet %d\n", binary.BigEndian.Uint16(p.Data))
+		}
+	case MT_Data:
+		if this.handlers[p.ConnId] == HT_FS {
+			this.fsRequest(p.Data)
+		}
+	}
+}
+
+func (this *dissector) toAmiga(p *InPacket) {
+
+	switch p.PacketType {
+	case MT_Hello:
+		if len(p.Data) >= 2 {
+			this.printf("    server version %d\n", binary.BigEndian.Uint16(p.Data))
+		}
+		// Older hellos go straight on to the handlers.
+		if this.version >= 2 && len(p.Data) >= 8 {
+			this.caps = binary.BigEndian.Uint32(p.Data[4:])
+		}
+	case MT_Connected:
+		if id, ok := this.pending[p.ConnId]; ok {
+			this.handlers[p.ConnId] = id
+			delete(this.pending, p.ConnId)
+		}
+	case MT_NoHandler:
+		delete(this.pending, p.ConnId)
+		this.error(p.Data)
+	case MT_NoConnection:
+		this.error(p.Data)
+	case MT_Disconnected:
+		delete(this.handlers, p.ConnId)
+	case MT_Ack, MT_Resend:
+		if len(p.Data) >= 2 {
+			this.printf("    packet %d\n", binary.BigEndian.Uint16(p.Data))
+		}
+	case MT_Error:
+		this.error(p.Data)
+	case MT_Data:
+		if this.handlers[p.ConnId] == HT_FS {
+			this.fsReply(p.Data)
+		}
+	}
+}
+
+func (this *dissector) error(data []byte) {
+
+	if this.caps&CAP_ErrorInfo == 0 {
+		if len(data) >= 2 {
+			this.printf("    %s %q\n", errorCodeName(binary.BigEndian.Uint16(data)), data[2:])
+		}
+		return
+	}
+
+	e, err := parseError(data)
+	if err != nil {
+		this.printf("    %s\n", err.Error())
+		return
+	}
+
+	this.printf("    %s\n", e.Error())
+}
+
+// fsRequest decodes the layout read by FsHandler.HandlePacket.
+func (this *dissector) fsRequest(data []byte) {
+
+	if len(data) < 26 {
+		this.printf("    FS short request\n")
+		return
+	}
+
+	reqId := binary.BigEndian.Uint32(data)
+	args := []int32{
+		int32(binary.BigEndian.Uint32(data[4:])),
+		int32(binary.BigEndian.Uint32(data[8:])),
+		int32(binary.BigEndian.Uint32(data[12:])),
+		int32(binary.BigEndian.Uint32(data[16:]))}
+	volId := binary.BigEndian.Uint16(data[20:])
+	reqType := binary.BigEndian.Uint16(data[22:])
+	dataLen := binary.BigEndian.Uint16(data[24:])
+
+	this.printf("    FS request %d vol %d %s args %d %d %d %d data %d\n",
+		reqId, volId, fsActionName(reqType), args[0], args[1], args[2], args[3], dataLen)
+
+	// Names are BCPL strings in the data, at offsets given by the args.
+	strData := data[26:]
+	var names []int32
+	switch reqType {
+	case PT_ACTION_LOCATE_OBJECT, PT_ACTION_DELETE_OBJECT, PT_ACTION_CREATE_DIR:
+		names = []int32{args[1]}
+	case PT_ACTION_FIND_INPUT, PT_ACTION_FIND_OUTPUT, PT_ACTION_FIND_UPDATE:
+		names = []int32{args[2]}
+	case PT_ACTION_RENAME_OBJECT:
+		names = []int32{args[1], args[3]}
+	}
+
+	for _, offset := range names {
+		if offset >= 0 && int(offset) < len(strData) && int(offset)+1+int(strData[offset]) <= len(strData) {
+			l := int32(strData[offset])
+			this.printf("      name %q\n", strData[offset+1:offset+1+l])
+		}
+	}
+}
+
+func (this *dissector) fsReply(data []byte) {
+
+	if len(data) >= 6 && binary.BigEndian.Uint32(data) == 0xFFFFFFFF {
+		this.printf("    FS volume %d mounted %q\n", binary.BigEndian.Uint16(data[4:]), strings.TrimRight(string(data[6:]), "\x00"))
+		return
+	}
+
+	if len(data) >= 6 && binary.BigEndian.Uint32(data) == 0xFFFFFFFE {
+		this.printf("    FS volume %d removed\n", binary.BigEndian.Uint16(data[4:]))
+		return
+	}
+
+	if len(data) < 14 {
+		this.printf("    FS short reply\n")
+		return
+	}
+
+	this.printf("    FS reply %d res1 %d res2 %d data %d\n",
+		binary.BigEndian.Uint32(data),
+		int32(binary.BigEndian.Uint32(data[4:])),
+		int32(binary.BigEndian.Uint32(data[8:])),
+		binary.BigEndian.Uint16(data[12:]))
+}
+
+// DumpMain is the amipiborg-dump command. It prints the packets in one or
+// more capture files.
+func DumpMain(args []string) int {
+
+	fl := flag.NewFlagSet("amipiborg-dump", flag.ContinueOnError)
+	hexDump := fl.Bool("x", false, "hex dump packet data")
+	fl.Usage = func() {
+		fmt.Fprintf(fl.Output(), "usage: amipiborg-dump [-x] capture...\n")
+		fl.PrintDefaults()
+	}
+
+	if err := fl.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	if fl.NArg() == 0 {
+		fl.Usage()
+		return 2
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	for _, path := range fl.Args() {
+
+		cr, err := OpenCapture(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+
+		d := newDissector(out, *hexDump)
+		for {
+			rec, err := cr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				out.Flush()
+				fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+				cr.Close()
+				return 1
+			}
+			d.record(rec)
+		}
+
+		cr.Close()
+	}
+
+	return 0
+}
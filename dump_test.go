@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDissectLegacyHello(t *testing.T) {
+
+	rr := &recordRemote{}
+	pw := NewPacketWriter(rr)
+
+	// A version 1 hello, the handler name lands where caps would be.
+	hello := new(bytes.Buffer)
+	binary.Write(hello, binary.BigEndian, uint16(ServerVersion))
+	binary.Write(hello, binary.BigEndian, uint16(1))
+	HandlerInfo{Id: HT_Ping, Name: "Ping"}.encodeLegacy(hello)
+
+	failed := new(bytes.Buffer)
+	binary.Write(failed, binary.BigEndian, uint16(EC_HandlerFailed))
+	failed.WriteString("boom")
+
+	pw.Write(MT_Init, 0, DEFAULT_CONNECTION, 1, []byte{})
+	pw.Write(MT_Hello, 0, DEFAULT_CONNECTION, 1, hello.Bytes())
+	pw.Write(MT_Error, 0, 5, 2, failed.Bytes())
+
+	out := new(bytes.Buffer)
+	d := newDissector(out, false)
+	for ix, data := range rr.written {
+		dir := uint8(CD_Out)
+		if ix == 0 {
+			dir = CD_In
+		}
+		d.record(CaptureRecord{Time: time.Now(), Direction: dir, Data: data})
+	}
+
+	if !strings.Contains(out.String(), `handler failed "boom"`) {
+		t.Fatalf("error not read the old way:\n%s", out.String())
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// FakeAmiga speaks the Amiga side of the protocol so a Server can be
+// driven without real hardware. Pair it with a PipeRemote:
+//
+//	srvEnd, amigaEnd := NewPipeRemote()
+//	go NewServer(srvEnd, hf).Run()
+//	amiga := NewFakeAmiga(amigaEnd)
+//	amiga.Start()
+//	amiga.Init()
+type FakeAmiga struct {
+	remote       Remote
+	bufPool      *BufferPool
+	packetReader *PacketReader
+	packetWriter *PacketWriter
+	writeLock    sync.Mutex
+	packId       uint16
+	sentPackets  map[uint16]*OutPacket
+	lastInPackId uint16
+	outOfOrder   map[uint16]*InPacket
+	reassembly   map[uint16]*reassembly
+	session      session
+	inChan       chan *InPacket
+	ctrlChan     chan bool
+	Timeout      time.Duration
+
+	// Version is the protocol version sent in MT_Init. Version 1 clients
+	// send an empty MT_Init and get the original MT_Hello back.
+	Version uint16
+
+	// WindowSize is offered to the server in MT_Init. Zero behaves like
+	// an old client that never acknowledges packets.
+	WindowSize uint16
+
+	// CRC asks the server for CRC-32 protected packets.
+	CRC bool
+
+	// HandlerInfo asks for full handler descriptors in MT_Hello.
+	HandlerInfo bool
+
+	// Compress offers compressed MT_Data.
+	Compress bool
+
+	// ErrorInfo asks for errors as ProtocolError.
+	ErrorInfo bool
+
+	// Keepalive offers to answer MT_Ping from the server. Pings are
+	// answered whatever this says, and never reach Receive.
+	Keepalive bool
+
+	// Fragment offers fragmented MT_Data. Send splits long messages and
+	// fragments received are put back together before Receive sees them.
+	Fragment bool
+
+	// Handlers lists what the server offered in the last MT_Hello.
+	Handlers []HandlerInfo
+
+	// DropIncoming, if set, is asked about every packet from the server.
+	// Returning true discards it as if it was lost on the line.
+	DropIncoming func(p *InPacket) bool
+}
+
+var ErrTimeout = errors.New("timed out waiting for packet")
+
+func NewFakeAmiga(remote Remote) (fa *FakeAmiga) {
+
+	bp := NewBufferPool(100)
+
+	fa = &FakeAmiga{
+		remote:       remote,
+		bufPool:      bp,
+		packetReader: NewPacketReader(bp, remote),
+		packetWriter: NewPacketWriter(remote),
+		packId:       1,
+		sentPackets:  make(map[uint16]*OutPacket),
+		outOfOrder:   make(map[uint16]*InPacket),
+		reassembly:   make(map[uint16]*reassembly),
+		inChan:       make(chan *InPacket, 100),
+		ctrlChan:     make(chan bool),
+		Timeout:      5 * time.Second,
+		Version:      AMIPIBORG_VERSION}
+
+	remote.Init(bp)
+
+	return fa
+}
+
+func (this *FakeAmiga) Start() (err error) {
+
+	err = this.remote.Open()
+	if err != nil {
+		return err
+	}
+
+	this.packetReader.Start()
+
+	go this.run()
+
+	return nil
+}
+
+func (this *FakeAmiga) Stop() {
+	this.ctrlChan <- true
+	this.packetReader.Stop()
+	this.remote.Close()
+}
+
+// Answers resend requests from the server and queues everything else for
+// Receive in packet id order, asking for any that went missing.
+func (this *FakeAmiga) run() {
+
+	rc := this.packetReader.GetOutputChannel()
+
+	done := false
+	for !done {
+		select {
+		case p := <-rc:
+			if this.DropIncoming != nil && this.DropIncoming(p) {
+				continue
+			}
+			if p.ConnId == DEFAULT_CONNECTION && p.PacketType == MT_Ack {
+				continue
+			}
+			this.receivePacket(p)
+		case done = <-this.ctrlChan:
+		}
+	}
+}
+
+func (this *FakeAmiga) receivePacket(p *InPacket) {
+
+	ahead := p.PacketId - this.lastInPackId
+	if ahead == 0 || ahead >= 0x8000 {
+		// Already seen.
+		this.sendAck()
+		return
+	}
+
+	if ahead > 1 {
+		if _, ok := this.outOfOrder[p.PacketId]; !ok && (p.Flags&PF_Resend) == 0 {
+			for id := this.lastInPackId + 1; id != p.PacketId; id++ {
+				if _, ok := this.outOfOrder[id]; !ok {
+					this.RequestResend(id)
+				}
+			}
+		}
+		this.outOfOrder[p.PacketId] = p
+		this.sendAck()
+		return
+	}
+
+	this.deliver(p)
+	for {
+		next, ok := this.outOfOrder[this.lastInPackId+1]
+		if !ok {
+			break
+		}
+		delete(this.outOfOrder, next.PacketId)
+		this.deliver(next)
+	}
+
+	this.sendAck()
+}
+
+func (this *FakeAmiga) deliver(p *InPacket) {
+
+	this.lastInPackId = p.PacketId
+
+	if p.ConnId == DEFAULT_CONNECTION && p.PacketType == MT_Resend {
+		this.resendPacket(binary.BigEndian.Uint16(p.Data))
+		return
+	}
+
+	if p.ConnId == DEFAULT_CONNECTION && p.PacketType == MT_Ping {
+		this.WritePacket(DEFAULT_CONNECTION, MT_Pong, []byte{})
+		return
+	}
+
+	if p.PacketType == MT_Data && p.Flags&PF_Fragment != 0 {
+		r, ok := this.reassembly[p.ConnId]
+		if !ok {
+			r = newReassembly()
+			this.reassembly[p.ConnId] = r
+		}
+		if p, _ = r.add(p); p == nil {
+			return
+		}
+	}
+
+	this.inChan <- p
+}
+
+func (this *FakeAmiga) sendAck() {
+
+	// Init changes the session under the write lock.
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	if !this.session.has(CAP_Window) {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, this.lastInPackId)
+
+	this.packetWriter.Write(MT_Ack, 0, DEFAULT_CONNECTION, 0, buf.Bytes())
+}
+
+func (this *FakeAmiga) resendPacket(packId uint16) {
+
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	if op, ok := this.sentPackets[packId]; ok {
+		this.packetWriter.Write(op.PacketType, op.Flags|PF_Resend, op.ConnId, op.PackId, op.Data)
+	}
+}
+
+func (this *FakeAmiga) RequestResend(packId uint16) {
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, packId)
+
+	this.WritePacket(DEFAULT_CONNECTION, MT_Resend, buf.Bytes())
+}
+
+// WritePacket sends a packet with the next packet id.
+func (this *FakeAmiga) WritePacket(connId uint16, packetType uint8, data []byte) (pId uint16, err error) {
+
+	return this.writePacket(&OutPacket{
+		ConnId:     connId,
+		PacketType: packetType,
+		Data:       data})
+}
+
+func (this *FakeAmiga) writePacket(op *OutPacket) (pId uint16, err error) {
+
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	pId = this.packId
+	err = this.packetWriter.Write(op.PacketType, op.Flags, op.ConnId, pId, op.Data)
+	if err != nil {
+		return 0, err
+	}
+
+	op.PackId = pId
+	this.sentPackets[pId] = op
+
+	this.packId++
+	return pId, nil
+}
+
+// SkipPacket uses up a packet id without sending anything, as if the packet
+// had been lost on the line.
+func (this *FakeAmiga) SkipPacket(connId uint16, packetType uint8, data []byte) (pId uint16) {
+
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	pId = this.packId
+	this.sentPackets[pId] = &OutPacket{
+		ConnId:     connId,
+		PackId:     pId,
+		PacketType: packetType,
+		Data:       data}
+
+	this.packId++
+	return pId
+}
+
+// Receive waits for the next packet from the server.
+func (this *FakeAmiga) Receive() (p *InPacket, err error) {
+
+	select {
+	case p = <-this.inChan:
+		return p, nil
+	case <-time.After(this.Timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// Expect waits for a packet of the given type on the given connection,
+// failing if anything else arrives first.
+func (this *FakeAmiga) Expect(connId uint16, packetType uint8) (p *InPacket, err error) {
+
+	p, err = this.Receive()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.ConnId != connId || p.PacketType != packetType {
+		return p, fmt.Errorf("expected packet type %#x on connection %d, got type %#x on connection %d",
+			packetType, connId, p.PacketType, p.ConnId)
+	}
+
+	return p, nil
+}
+
+// Init performs the MT_Init/MT_Hello handshake and returns the server
+// version and the handlers it offers.
+func (this *FakeAmiga) Init() (version uint16, handlers map[uint16]string, err error) {
+
+	this.writeLock.Lock()
+	this.packId = 1
+	this.sentPackets = make(map[uint16]*OutPacket)
+	this.lastInPackId = 0
+	this.outOfOrder = make(map[uint16]*InPacket)
+	this.session = session{}
+	this.packetWriter.SetCRC(false)
+	this.packetWriter.SetCompression(false)
+	this.packetReader.SetRequireCRC(false)
+	this.writeLock.Unlock()
+
+	ci := clientInit{version: this.Version, window: this.WindowSize}
+	if this.WindowSize > 0 {
+		ci.caps |= CAP_Window
+	}
+	if this.CRC {
+		ci.caps |= CAP_CRC32
+	}
+	if this.HandlerInfo {
+		ci.caps |= CAP_HandlerInfo
+	}
+	if this.Compress {
+		ci.caps |= CAP_Compress
+	}
+	if this.Fragment {
+		ci.caps |= CAP_Fragment
+	}
+	if this.ErrorInfo {
+		ci.caps |= CAP_ErrorInfo
+	}
+	if this.Keepalive {
+		ci.caps |= CAP_Keepalive
+	}
+
+	if _, err = this.WritePacket(DEFAULT_CONNECTION, MT_Init, ci.encode()); err != nil {
+		return 0, nil, err
+	}
+
+	p, err := this.Expect(DEFAULT_CONNECTION, MT_Hello)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	buf := bytes.NewReader(p.Data)
+
+	binary.Read(buf, binary.BigEndian, &version)
+
+	s := session{version: 1}
+	if this.Version >= 2 {
+		binary.Read(buf, binary.BigEndian, &s.version)
+		binary.Read(buf, binary.BigEndian, &s.caps)
+		binary.Read(buf, binary.BigEndian, &s.window)
+	}
+
+	var count uint16
+	binary.Read(buf, binary.BigEndian, &count)
+
+	handlers = make(map[uint16]string)
+	this.Handlers = make([]HandlerInfo, 0, count)
+	for ix := uint16(0); ix < count; ix++ {
+		var info HandlerInfo
+		if s.has(CAP_HandlerInfo) {
+			if info, err = decodeHandlerInfo(buf); err != nil {
+				return 0, nil, err
+			}
+		} else {
+			name := make([]byte, LegacyNameLength)
+			binary.Read(buf, binary.BigEndian, &info.Id)
+			if _, err = io.ReadFull(buf, name); err != nil {
+				return 0, nil, err
+			}
+			info.Name = string(bytes.TrimRight(name, "\x00"))
+		}
+		handlers[info.Id] = info.Name
+		this.Handlers = append(this.Handlers, info)
+	}
+
+	this.writeLock.Lock()
+	this.session = s
+	crc := s.has(CAP_CRC32)
+	this.packetWriter.SetCRC(crc)
+	this.packetReader.SetRequireCRC(crc)
+	this.packetWriter.SetCompression(s.has(CAP_Compress))
+	this.writeLock.Unlock()
+
+	this.sendAck()
+
+	return version, handlers, nil
+}
+
+// Connect opens a connection to a handler.
+func (this *FakeAmiga) Connect(connId uint16, handlerId uint16) (err error) {
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, handlerId)
+
+	if _, err = this.WritePacket(connId, MT_Connect, buf.Bytes()); err != nil {
+		return err
+	}
+
+	_, err = this.Expect(connId, MT_Connected)
+	return err
+}
+
+func (this *FakeAmiga) Disconnect(connId uint16) (err error) {
+
+	if _, err = this.WritePacket(connId, MT_Disconnect, []byte{}); err != nil {
+		return err
+	}
+
+	_, err = this.Expect(connId, MT_Disconnected)
+	return err
+}
+
+// Send sends data on a connection, in fragments if it is too long for one
+// packet and the server agreed to them.
+func (this *FakeAmiga) Send(connId uint16, data []byte) (err error) {
+
+	op := &OutPacket{
+		ConnId:     connId,
+		PacketType: MT_Data,
+		Data:       data}
+
+	ops := []*OutPacket{op}
+	if this.session.has(CAP_Fragment) {
+		if ops, err = fragment(op); err != nil {
+			return err
+		}
+	}
+
+	for _, op = range ops {
+		if _, err = this.writePacket(op); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *FakeAmiga) Ping() (err error) {
+
+	if _, err = this.WritePacket(DEFAULT_CONNECTION, MT_Ping, []byte{}); err != nil {
+		return err
+	}
+
+	_, err = this.Expect(DEFAULT_CONNECTION, MT_Pong)
+	return err
+}
+
+func (this *FakeAmiga) Shutdown() (err error) {
+
+	if _, err = this.WritePacket(DEFAULT_CONNECTION, MT_Shutdown, []byte{}); err != nil {
+		return err
+	}
+
+	_, err = this.Expect(DEFAULT_CONNECTION, MT_Goodbye)
+	return err
+}
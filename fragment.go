@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Messages too long for one packet go as a run of MT_Data fragments, each
+// flagged PF_Fragment, the last one also PF_LastFragment. The data of each
+// fragment starts with
+//
+//	uint16 index of the fragment in the message, from 0
+//
+// followed by the next piece of the message.
+const (
+	FRAGMENT_HEADER_LENGTH = 2
+	MAX_FRAGMENT_DATA      = MAX_PACKET_LENGTH - FRAGMENT_HEADER_LENGTH
+
+	// Longest message we put back together, so a broken sender can't
+	// eat all our memory.
+	MaxMessageLength = 16 * 1024 * 1024
+)
+
+// fragment splits a message into packets that fit the line. Messages that
+// fit already are returned as they are, messages longer than the other end
+// puts back together are refused.
+func fragment(op *OutPacket) (ops []*OutPacket, err error) {
+
+	if op.PacketType != MT_Data || len(op.Data) <= MAX_PACKET_LENGTH {
+		return []*OutPacket{op}, nil
+	}
+
+	if len(op.Data) > MaxMessageLength {
+		return nil, fmt.Errorf("message of %d bytes longer than %d", len(op.Data), MaxMessageLength)
+	}
+
+	data := op.Data
+	for ix := 0; len(data) > 0; ix++ {
+
+		n := len(data)
+		if n > MAX_FRAGMENT_DATA {
+			n = MAX_FRAGMENT_DATA
+		}
+
+		buf := make([]byte, FRAGMENT_HEADER_LENGTH+n)
+		binary.BigEndian.PutUint16(buf, uint16(ix))
+		copy(buf[FRAGMENT_HEADER_LENGTH:], data[:n])
+		data = data[n:]
+
+		flags := uint8(PF_Fragment)
+		if len(data) == 0 {
+			flags |= PF_LastFragment
+		}
+
+		ops = append(ops, &OutPacket{
+			ConnId:     op.ConnId,
+			PacketType: op.PacketType,
+			Flags:      flags,
+			Data:       buf})
+	}
+
+	return ops, nil
+}
+
+// reassembly collects the fragments of a message. They may arrive in any
+// order and more than once.
+type reassembly struct {
+	parts map[uint16][]byte
+	last  int
+	size  int
+}
+
+func newReassembly() *reassembly {
+	return &reassembly{
+		parts: make(map[uint16][]byte),
+		last:  -1}
+}
+
+// add takes a fragment and returns the whole message once every fragment
+// is in. After an error the partial message is thrown away.
+func (this *reassembly) add(p *InPacket) (msg *InPacket, err error) {
+
+	if len(p.Data) < FRAGMENT_HEADER_LENGTH {
+		this.reset()
+		return nil, fmt.Errorf("short fragment, %d bytes", len(p.Data))
+	}
+
+	ix := binary.BigEndian.Uint16(p.Data)
+	part := p.Data[FRAGMENT_HEADER_LENGTH:]
+
+	if old, ok := this.parts[ix]; ok {
+		this.size -= len(old)
+	}
+	this.parts[ix] = part
+	this.size += len(part)
+
+	if p.Flags&PF_LastFragment != 0 {
+		this.last = int(ix)
+	}
+
+	if this.size > MaxMessageLength {
+		this.reset()
+		return nil, fmt.Errorf("message longer than %d bytes", MaxMessageLength)
+	}
+
+	if this.last < 0 || len(this.parts) < this.last+1 {
+		return nil, nil
+	}
+
+	data := make([]byte, 0, this.size)
+	for ix := 0; ix <= this.last; ix++ {
+		part, ok := this.parts[uint16(ix)]
+		if !ok {
+			// Something past the last fragment, the sender is confused.
+			this.reset()
+			return nil, fmt.Errorf("fragment %d missing", ix)
+		}
+		data = append(data, part...)
+	}
+
+	this.reset()
+
+	// Length can't say how long a message of 64K or more is, use len(Data).
+	msg = &InPacket{
+		PacketType: p.PacketType,
+		Flags:      p.Flags &^ (PF_Fragment | PF_LastFragment),
+		ConnId:     p.ConnId,
+		PacketId:   p.PacketId,
+		Length:     uint16(len(data)),
+		Data:       data}
+
+	if len(data) > 0xffff {
+		msg.Length = 0xffff
+	}
+
+	return msg, nil
+}
+
+func (this *reassembly) reset() {
+	this.parts = make(map[uint16][]byte)
+	this.last = -1
+	this.size = 0
+}
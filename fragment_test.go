@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+)
+
+func TestFragmentedLink(t *testing.T) {
+
+	_, amiga := startServer(t, nil)
+	amiga.Fragment = true
+	amiga.Compress = true
+	amiga.WindowSize = 4
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(3, HT_Ping); err != nil {
+		t.Fatal(err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, size := range []int{10, MAX_PACKET_LENGTH, MAX_PACKET_LENGTH + 1, 100000} {
+		msg := make([]byte, size)
+		rnd.Read(msg)
+		if err := amiga.Send(3, msg); err != nil {
+			t.Fatal(err)
+		}
+		p, err := amiga.Expect(3, MT_Data)
+		if err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(p.Data, msg) {
+			t.Fatalf("%d bytes came back as %d", size, len(p.Data))
+		}
+	}
+}
+
+func TestReassemblyOrder(t *testing.T) {
+
+	msg := make([]byte, 3*MAX_FRAGMENT_DATA+5)
+	rand.New(rand.NewSource(1)).Read(msg)
+
+	ops, err := fragment(&OutPacket{PacketType: MT_Data, Data: msg})
+	if err != nil || len(ops) != 4 {
+		t.Fatal(len(ops), err)
+	}
+
+	// Out of order, and one twice.
+	r := newReassembly()
+	var got *InPacket
+	for _, ix := range []int{3, 1, 1, 0, 2} {
+		p, err := r.add(&InPacket{PacketType: MT_Data, Flags: ops[ix].Flags, Data: ops[ix].Data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != nil {
+			got = p
+		}
+	}
+
+	if got == nil || !bytes.Equal(got.Data, msg) || got.Flags != 0 {
+		t.Fatal("message not put back together")
+	}
+}
+
+// hugeHandler answers with a message of size bytes.
+type hugeHandler struct {
+	size int
+}
+
+func (this hugeHandler) Serve(ctx context.Context, conn *HandlerConn) error {
+
+	select {
+	case <-conn.Packets():
+		return conn.Send(make([]byte, this.size))
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func TestFragmentTooLong(t *testing.T) {
+
+	if _, err := fragment(&OutPacket{PacketType: MT_Data, Data: make([]byte, MaxMessageLength+1)}); err == nil {
+		t.Fatal("fragmented a message longer than MaxMessageLength")
+	}
+
+	_, amiga := startServer(t, func(srv *Server, hf *HandlerFactory) {
+		hf.AddContextHandler(0x77, "HUGE", func() ContextHandler { return hugeHandler{size: MaxMessageLength + 1} })
+	})
+	amiga.Fragment = true
+	amiga.ErrorInfo = true
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(3, 0x77); err != nil {
+		t.Fatal(err)
+	}
+
+	amiga.Send(3, []byte{1})
+	p, err := amiga.Expect(3, MT_Error)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := parseError(p.Data); err != nil || e.Code != EC_MessageTooLong {
+		t.Fatal(e, err)
+	}
+	if _, err = amiga.Expect(3, MT_Disconnected); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyLongMessage(t *testing.T) {
+
+	// Without fragments a message goes in one piece if it fits a packet,
+	// anything longer closes the connection.
+	c := NewConnection(3, HandlerInfo{}, hugeHandler{}, nil)
+	for _, tc := range []struct {
+		size int
+		ops  int
+	}{
+		{MAX_PACKET_LENGTH - 1, 1},
+		{MAX_PACKET_LENGTH, 1},
+		{MAX_PACKET_LENGTH + 1, 2},
+		{65520, 2},
+		{65521, 2},
+		{70000, 2},
+	} {
+		ops := c.split(&OutPacket{PacketType: MT_Data, Data: make([]byte, tc.size)})
+		if len(ops) != tc.ops {
+			t.Fatalf("%d bytes split into %d packets", tc.size, len(ops))
+		}
+		if tc.ops == 1 && len(ops[0].Data) != tc.size {
+			t.Fatalf("%d bytes sent as %d", tc.size, len(ops[0].Data))
+		}
+		if tc.ops == 2 && (ops[0].PacketType != MT_Error || ops[1].PacketType != MT_Disconnected) {
+			t.Fatalf("%d bytes sent as %d, %d", tc.size, ops[0].PacketType, ops[1].PacketType)
+		}
+	}
+
+	_, amiga := startServer(t, func(srv *Server, hf *HandlerFactory) {
+		hf.AddContextHandler(0x77, "HUGE", func() ContextHandler { return hugeHandler{size: MAX_PACKET_LENGTH + 1} })
+	})
+	amiga.Version = 1
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(3, 0x77); err != nil {
+		t.Fatal(err)
+	}
+
+	// An old client knows no MT_Error, it is told the connection is gone.
+	amiga.Send(3, []byte{1})
+	if _, err := amiga.Expect(3, MT_Disconnected); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,13 +3,18 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -59,6 +64,37 @@ const (
 	PT_ACTION_EXAMINE_FH     = 1034
 )
 
+var fsActionNames = map[uint16]string{
+	PT_ACTION_LOCATE_OBJECT:  "LOCATE_OBJECT",
+	PT_ACTION_FREE_LOCK:      "FREE_LOCK",
+	PT_ACTION_DELETE_OBJECT:  "DELETE_OBJECT",
+	PT_ACTION_RENAME_OBJECT:  "RENAME_OBJECT",
+	PT_ACTION_CREATE_DIR:     "CREATE_DIR",
+	PT_ACTION_EXAMINE_OBJECT: "EXAMINE_OBJECT",
+	PT_ACTION_EXAMINE_NEXT:   "EXAMINE_NEXT",
+	PT_ACTION_DISK_INFO:      "DISK_INFO",
+	PT_ACTION_INFO:           "INFO",
+	PT_ACTION_PARENT:         "PARENT",
+	PT_ACTION_SAME_LOCK:      "SAME_LOCK",
+	PT_ACTION_READ:           "READ",
+	PT_ACTION_WRITE:          "WRITE",
+	PT_ACTION_FIND_UPDATE:    "FIND_UPDATE",
+	PT_ACTION_FIND_INPUT:     "FIND_INPUT",
+	PT_ACTION_FIND_OUTPUT:    "FIND_OUTPUT",
+	PT_ACTION_END:            "END",
+	PT_ACTION_SEEK:           "SEEK",
+	PT_ACTION_FH_FROM_LOCK:   "FH_FROM_LOCK",
+	PT_ACTION_PARENT_FH:      "PARENT_FH",
+	PT_ACTION_EXAMINE_FH:     "EXAMINE_FH"}
+
+func fsActionName(reqType uint16) string {
+
+	if name, ok := fsActionNames[reqType]; ok {
+		return name
+	}
+	return fmt.Sprintf("ACTION_%d", reqType)
+}
+
 const (
 	SHARED_LOCK    = -2
 	ACCESS_READ    = -2
@@ -68,45 +104,91 @@ const (
 	DOS_FALSE = 0
 	DOS_TRUE  = -1
 
-	ERROR_OBJECT_IN_USE      = 202
-	ERROR_OBJECT_WRONG_TYPE  = 212
-	ERROR_DIR_NOT_FOUND      = 204
-	ERROR_OBJECT_NOT_FOUND   = 205
-	ERROR_OBJECT_EXISTS      = 203
-	ERROR_DEVICE_NOT_MOUNTED = 218
-	ERROR_NO_MORE_ENTRIES    = 232
+	ERROR_NO_FREE_STORE          = 103
+	ERROR_OBJECT_IN_USE          = 202
+	ERROR_OBJECT_EXISTS          = 203
+	ERROR_DIR_NOT_FOUND          = 204
+	ERROR_OBJECT_NOT_FOUND       = 205
+	ERROR_OBJECT_TOO_LARGE       = 207
+	ERROR_INVALID_COMPONENT_NAME = 210
+	ERROR_OBJECT_WRONG_TYPE      = 212
+	ERROR_DISK_WRITE_PROTECTED   = 214
+	ERROR_RENAME_ACROSS_DEVICES  = 215
+	ERROR_DIRECTORY_NOT_EMPTY    = 216
+	ERROR_TOO_MANY_LEVELS        = 217
+	ERROR_DEVICE_NOT_MOUNTED     = 218
+	ERROR_SEEK_ERROR             = 219
+	ERROR_DISK_FULL              = 221
+	ERROR_DELETE_PROTECTED       = 222
+	ERROR_WRITE_PROTECTED        = 223
+	ERROR_READ_PROTECTED         = 224
+	ERROR_NO_MORE_ENTRIES        = 232
 
 	OFFSET_BEGINNING = -1
 	OFFSET_CURRENT   = 0
 	OFFSET_END       = 1
 )
 
-const defaultFsName string = "AmiPiBorg"
-const defaultFsPath string = "/home/pi"
-const mountPath string = "/media/pi"
-
-func translateError(err error) int32 {
-
-	fmt.Println(err.Error())
-
-	if os.IsExist(err) {
-		return ERROR_OBJECT_EXISTS
+// The AmigaDOS errors closest to what the host says. Permission problems
+// depend on the request, see permissionCode.
+var errnoCodes = map[syscall.Errno]int32{
+	syscall.ENOENT:       ERROR_OBJECT_NOT_FOUND,
+	syscall.EEXIST:       ERROR_OBJECT_EXISTS,
+	syscall.EROFS:        ERROR_DISK_WRITE_PROTECTED,
+	syscall.ENOSPC:       ERROR_DISK_FULL,
+	syscall.EDQUOT:       ERROR_DISK_FULL,
+	syscall.ENOTEMPTY:    ERROR_DIRECTORY_NOT_EMPTY,
+	syscall.ENOTDIR:      ERROR_OBJECT_WRONG_TYPE,
+	syscall.EISDIR:       ERROR_OBJECT_WRONG_TYPE,
+	syscall.EXDEV:        ERROR_RENAME_ACROSS_DEVICES,
+	syscall.EBUSY:        ERROR_OBJECT_IN_USE,
+	syscall.ETXTBSY:      ERROR_OBJECT_IN_USE,
+	syscall.ENAMETOOLONG: ERROR_INVALID_COMPONENT_NAME,
+	syscall.ELOOP:        ERROR_TOO_MANY_LEVELS,
+	syscall.EFBIG:        ERROR_OBJECT_TOO_LARGE,
+	syscall.ENOMEM:       ERROR_NO_FREE_STORE,
+	syscall.ESPIPE:       ERROR_SEEK_ERROR,
+	syscall.ENODEV:       ERROR_DEVICE_NOT_MOUNTED,
+	syscall.ENXIO:        ERROR_DEVICE_NOT_MOUNTED}
+
+// permissionCode is the protection a request of reqType ran into.
+func permissionCode(reqType uint16) int32 {
+
+	switch reqType {
+	case PT_ACTION_DELETE_OBJECT:
+		return ERROR_DELETE_PROTECTED
+	case PT_ACTION_WRITE, PT_ACTION_FIND_OUTPUT, PT_ACTION_FIND_UPDATE, PT_ACTION_CREATE_DIR, PT_ACTION_RENAME_OBJECT:
+		return ERROR_WRITE_PROTECTED
 	}
 
-	if os.IsNotExist(err) {
-		return ERROR_OBJECT_NOT_FOUND
-	}
+	return ERROR_READ_PROTECTED
+}
 
-	if os.IsPermission(err) {
-		return ERROR_OBJECT_IN_USE
+// translateError finds the AmigaDOS error for err from a request of
+// reqType. It returns false with ERROR_OBJECT_NOT_FOUND if there is none
+// that fits.
+func translateError(err error, reqType uint16) (code int32, exact bool) {
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if errno == syscall.EACCES || errno == syscall.EPERM {
+			return permissionCode(reqType), true
+		}
+		if code, ok := errnoCodes[errno]; ok {
+			return code, true
+		}
 	}
 
-	switch err.(type) {
-	case *os.PathError:
-		return ERROR_DIR_NOT_FOUND
+	switch {
+	case errors.Is(err, os.ErrExist):
+		return ERROR_OBJECT_EXISTS, true
+	case errors.Is(err, os.ErrNotExist):
+		return ERROR_OBJECT_NOT_FOUND, true
+	case errors.Is(err, os.ErrPermission):
+		return permissionCode(reqType), true
 	}
 
-	return ERROR_OBJECT_NOT_FOUND
+	return ERROR_OBJECT_NOT_FOUND, false
 }
 
 var AmigaEpoch time.Time = time.Date(1978, 1, 1, 0, 0, 0, 0, time.Local)
@@ -127,39 +209,62 @@ type fsFileHandle struct {
 type fileSystem struct {
 	isDefault bool
 	isMounted bool
-	outChan   chan *OutPacket
+	outbox    *fsOutbox
 	id        uint16
 	name      string
 	rootPath  string
 	nextId    int32
 	locks     map[int32]*fsLock
 	files     map[int32]*fsFileHandle
+	log       *slog.Logger
 }
 
-func createFileSystem(outChan chan *OutPacket, id uint16, name string, rootPath string) *fileSystem {
-
-	isDefault := false
-	if name == defaultFsName {
-		isDefault = true
-	}
+func createFileSystem(outbox *fsOutbox, id uint16, name string, rootPath string, isDefault bool, log *slog.Logger) *fileSystem {
 
-	fs := &fileSystem{isDefault, true, outChan, id, name, rootPath, 1, make(map[int32]*fsLock), make(map[int32]*fsFileHandle)}
+	fs := &fileSystem{isDefault, true, outbox, id, name, rootPath, 1, make(map[int32]*fsLock), make(map[int32]*fsFileHandle), log.With("volume", name)}
 
 	return fs
 }
 
+// fsOutbox holds the packets for the Amiga made while FsHandler.lock is
+// held. They are sent once it is released, the server may not take them
+// straight away and the volume watcher or admin socket would wait meanwhile.
+type fsOutbox struct {
+	packets []*OutPacket
+}
+
+func (this *fsOutbox) queue(op *OutPacket) {
+	this.packets = append(this.packets, op)
+}
+
 type FsHandler struct {
 	outChan     chan *OutPacket
+	outbox      fsOutbox
 	quitChan    chan bool
 	nextId      uint16
 	fileSystems map[uint16]*fileSystem
+	lock        sync.Mutex
+	config      FsConfig
+	actionTime  *HistogramVec
+	volumes     *Gauge
+	log         *slog.Logger
 }
 
+func (this *FsHandler) SetLogger(log *slog.Logger) {
+	this.log = log
+}
+
+// The volume watcher and the admin socket run alongside the handler, lock
+// holds them off while the handler touches its file systems.
 func (this *FsHandler) Init(outChan chan *OutPacket) {
+	this.lock.Lock()
+	defer this.unlock()
+
 	this.outChan = outChan
+	this.quitChan = make(chan bool)
 	this.fileSystems = make(map[uint16]*fileSystem)
 	this.nextId = 1
-	this.fileSystems[0] = createFileSystem(this.outChan, 0, defaultFsName, defaultFsPath)
+	this.fileSystems[0] = createFileSystem(&this.outbox, 0, this.config.DefaultName, this.config.DefaultPath, true, this.log)
 	this.fileSystems[0].mount()
 
 	this.checkMountedVolumes()
@@ -171,37 +276,51 @@ func (this *FsHandler) monitorVolumes() {
 
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
-		fmt.Printf("Unable to create FS Watcher")
+		this.log.Error("Unable to create FS watcher", "err", err)
 		return
 	}
 	defer w.Close()
 
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
+	err = w.Add(this.config.MountPath)
+	if err != nil {
+		this.log.Error("Unable to watch mount path", "path", this.config.MountPath, "err", err)
+		return
+	}
 
-			case <-w.Events:
-				this.checkMountedVolumes()
+	for {
+		select {
 
-			case <-done:
-				return
+		case <-w.Events:
+			this.lock.Lock()
+			this.checkMountedVolumes()
+			this.unlock()
+
+		case <-this.quitChan:
+			return
 
-			}
 		}
-	}()
+	}
+}
 
-	err = w.Add(mountPath)
-	if err != nil {
-		done <- true
+// unlock releases lock, then sends what was queued while it was held.
+func (this *FsHandler) unlock() {
+
+	packets := this.outbox.packets
+	this.outbox.packets = nil
+	this.lock.Unlock()
+
+	for _, op := range packets {
+		select {
+		case this.outChan <- op:
+		case <-this.quitChan:
+			return
+		}
 	}
-	<-this.quitChan
-	done <- true
 }
 
 func (this *FsHandler) checkMountedVolumes() {
 
-	entries, err := ioutil.ReadDir(mountPath)
+	entries, err := ioutil.ReadDir(this.config.MountPath)
 	if err != nil {
 		return
 	}
@@ -223,7 +342,7 @@ func (this *FsHandler) checkMountedVolumes() {
 		}
 
 		if !found {
-			fmt.Printf("New volume \"%s\"\n", entry.Name())
+			this.log.Info("New volume", "volume", entry.Name())
 			newVolumes = append(newVolumes, entry)
 		}
 	}
@@ -242,7 +361,7 @@ func (this *FsHandler) checkMountedVolumes() {
 		}
 
 		if !found {
-			fmt.Printf("Missing volume \"%s\"\n", vol.name)
+			this.log.Info("Missing volume", "volume", vol.name)
 			missingVolumes = append(missingVolumes, vol)
 		}
 	}
@@ -252,11 +371,19 @@ func (this *FsHandler) checkMountedVolumes() {
 	}
 
 	for _, entry := range newVolumes {
-		vol := createFileSystem(this.outChan, this.nextId, entry.Name(), filepath.Join(mountPath, entry.Name()))
+		vol := createFileSystem(&this.outbox, this.nextId, entry.Name(), filepath.Join(this.config.MountPath, entry.Name()), false, this.log)
 		vol.mount()
 		this.nextId++
 		this.fileSystems[vol.id] = vol
 	}
+
+	mounted := 0
+	for _, vol := range this.fileSystems {
+		if vol.isMounted {
+			mounted++
+		}
+	}
+	this.volumes.Set(float64(mounted))
 }
 
 func (this *fileSystem) findLock(id int32) *fsLock {
@@ -307,9 +434,9 @@ func (this *fileSystem) sendCreateNotification() {
 	buf.Write([]byte(this.name))
 	buf.Write([]byte{0})
 
-	this.outChan <- &OutPacket{
+	this.outbox.queue(&OutPacket{
 		PacketType: MT_Data,
-		Data:       buf.Bytes()}
+		Data:       buf.Bytes()})
 }
 
 func (this *fileSystem) sendRemoveNotification() {
@@ -319,9 +446,9 @@ func (this *fileSystem) sendRemoveNotification() {
 	binary.Write(buf, binary.BigEndian, uint32(0xFFFFFFFE))
 	binary.Write(buf, binary.BigEndian, this.id)
 
-	this.outChan <- &OutPacket{
+	this.outbox.queue(&OutPacket{
 		PacketType: MT_Data,
-		Data:       buf.Bytes()}
+		Data:       buf.Bytes()})
 }
 
 func (this *fileSystem) mount() {
@@ -340,14 +467,20 @@ func (this *fileSystem) unmount() {
 
 	this.locks = make(map[int32]*fsLock)
 
+	this.closeFiles()
+}
+
+func (this *fileSystem) closeFiles() {
+
 	for _, fh := range this.files {
+		this.log.Debug("Closed file", "path", fh.path)
 		fh.fh.Close()
 	}
 
 	this.files = make(map[int32]*fsFileHandle)
 }
 
-func replyToPacket(outChan chan *OutPacket, p *InPacket, req *FsRequest, res1 int32, res2 int32, data []byte) {
+func replyToPacket(outbox *fsOutbox, p *InPacket, req *FsRequest, res1 int32, res2 int32, data []byte) {
 
 	buf := new(bytes.Buffer)
 
@@ -360,18 +493,33 @@ func replyToPacket(outChan chan *OutPacket, p *InPacket, req *FsRequest, res1 in
 		buf.Write(data)
 	}
 
-	outChan <- &OutPacket{
+	outbox.queue(&OutPacket{
 		PacketType: MT_Data,
-		Data:       buf.Bytes()}
+		Data:       buf.Bytes()})
+}
+
+// errorCode gives the AmigaDOS error for a failed request. When none fits,
+// the Amiga is also sent what actually went wrong.
+func (this *fileSystem) errorCode(req *FsRequest, err error) int32 {
+
+	code, exact := translateError(err, req.reqType)
+	if exact {
+		this.log.Debug("Request failed", "err", err)
+	} else {
+		this.log.Warn("Request failed", "err", err)
+		this.outbox.queue(errorPacket(EC_RequestFailed, err.Error()))
+	}
+
+	return code
 }
 
 func (this *fileSystem) replyToPacket(p *InPacket, req *FsRequest, res1 int32, res2 int32, data []byte) {
-	replyToPacket(this.outChan, p, req, res1, res2, data)
+	replyToPacket(this.outbox, p, req, res1, res2, data)
 }
 
-func (this *fileSystem) createLock(path string, access int32) (l *fsLock, code int32) {
+func (this *fileSystem) createLock(req *FsRequest, path string, access int32) (l *fsLock, code int32) {
 
-	fmt.Printf("Locking path '%s'\n", path)
+	this.log.Debug("Locking path", "path", path)
 	l = this.findLockByPath(path)
 
 	if l != nil && access == EXCLUSIVE_LOCK && !l.freed {
@@ -380,7 +528,7 @@ func (this *fileSystem) createLock(path string, access int32) (l *fsLock, code i
 	}
 
 	if _, err := os.Stat(path); err != nil {
-		return nil, translateError(err)
+		return nil, this.errorCode(req, err)
 	}
 
 	l = &fsLock{this.nextId, path, access, false}
@@ -396,7 +544,7 @@ func (this *fileSystem) actionLocateObject(p *InPacket, req *FsRequest) {
 
 	path := this.resolvePath(req.arg1, req.getString(req.arg2))
 
-	l, code := this.createLock(path, req.arg3)
+	l, code := this.createLock(req, path, req.arg3)
 
 	if l == nil {
 		this.replyToPacket(p, req, DOS_FALSE, code, []byte{})
@@ -410,7 +558,7 @@ func (this *fileSystem) actionFreeLock(p *InPacket, req *FsRequest) {
 	l := this.findLock(req.arg1)
 
 	if l != nil {
-		fmt.Printf("Unlocking path '%s', id %d\n", l.name, req.arg1)
+		this.log.Debug("Unlocking path", "path", l.name, "lock", req.arg1)
 
 		if l.mode == EXCLUSIVE_LOCK {
 			delete(this.locks, req.arg1)
@@ -437,7 +585,7 @@ func (this *fileSystem) openFile(p *InPacket, req *FsRequest, path string) {
 	switch req.reqType {
 	case PT_ACTION_FIND_INPUT, PT_ACTION_FH_FROM_LOCK:
 		if err != nil && os.IsNotExist(err) {
-			fmt.Printf("Failed to open existing file %s: %s\n", path, err.Error())
+			this.log.Debug("Failed to open existing file", "path", path, "err", err)
 			this.replyToPacket(p, req, DOS_FALSE, ERROR_OBJECT_NOT_FOUND, []byte{})
 			return
 		}
@@ -448,8 +596,8 @@ func (this *fileSystem) openFile(p *InPacket, req *FsRequest, path string) {
 	case PT_ACTION_FIND_OUTPUT:
 		if err == nil {
 			if err = os.Remove(path); err != nil {
-				fmt.Printf("Failed to replace existing file %s: %s\n", path, err.Error())
-				this.replyToPacket(p, req, DOS_FALSE, translateError(err), []byte{})
+				this.log.Warn("Failed to replace existing file", "path", path, "err", err)
+				this.replyToPacket(p, req, DOS_FALSE, this.errorCode(req, err), []byte{})
 				return
 			}
 		}
@@ -457,22 +605,21 @@ func (this *fileSystem) openFile(p *InPacket, req *FsRequest, path string) {
 	}
 
 	if fi != nil && !fi.Mode().IsRegular() {
-		fmt.Printf("%s: is not a file\n", path)
+		this.log.Debug("Not a file", "path", path)
 		this.replyToPacket(p, req, DOS_FALSE, ERROR_OBJECT_WRONG_TYPE, []byte{})
 		return
 	}
 
 	if f, err := os.OpenFile(path, mode, 0755); err == nil {
 
-		fmt.Printf("Open file %s\n", path)
+		this.log.Debug("Open file", "path", path, "file", this.nextId)
 
 		fh := &fsFileHandle{this.nextId, f, path}
 		this.files[this.nextId] = fh
 		this.nextId++
 		this.replyToPacket(p, req, DOS_TRUE, fh.id, []byte{})
 	} else {
-		fmt.Printf("Failed to open %s: %s\n", path, err.Error())
-		this.replyToPacket(p, req, DOS_FALSE, translateError(err), []byte{})
+		this.replyToPacket(p, req, DOS_FALSE, this.errorCode(req, err), []byte{})
 	}
 }
 
@@ -480,10 +627,10 @@ func (this *fileSystem) actionCloseFile(p *InPacket, req *FsRequest) {
 
 	fh := this.files[req.arg1]
 	if fh != nil {
-		fmt.Printf("Closed file %s\n", fh.path)
+		this.log.Debug("Closed file", "path", fh.path, "file", req.arg1)
 		fh.fh.Close()
 	} else {
-		fmt.Printf("Could not close file %d\n", req.arg1)
+		this.log.Warn("Could not close file", "file", req.arg1)
 	}
 
 	delete(this.files, req.arg1)
@@ -505,7 +652,7 @@ func (this *fileSystem) actionExamine(p *InPacket, req *FsRequest) {
 
 	fi, err := os.Stat(path)
 	if err != nil {
-		this.replyToPacket(p, req, DOS_FALSE, translateError(err), []byte{})
+		this.replyToPacket(p, req, DOS_FALSE, this.errorCode(req, err), []byte{})
 		return
 	}
 
@@ -524,11 +671,11 @@ func (this *fileSystem) actionExamineFh(p *InPacket, req *FsRequest) {
 		return
 	}
 
-	fmt.Printf("Examining %s\n", fh.path)
+	this.log.Debug("Examining", "path", fh.path)
 
 	fi, err := os.Stat(fh.path)
 	if err != nil {
-		this.replyToPacket(p, req, DOS_FALSE, translateError(err), []byte{})
+		this.replyToPacket(p, req, DOS_FALSE, this.errorCode(req, err), []byte{})
 		return
 	}
 
@@ -546,7 +693,7 @@ func (this *fileSystem) actionExamineNext(p *InPacket, req *FsRequest) {
 	entries, err := ioutil.ReadDir(path)
 
 	if err != nil {
-		this.replyToPacket(p, req, DOS_FALSE, translateError(err), []byte{})
+		this.replyToPacket(p, req, DOS_FALSE, this.errorCode(req, err), []byte{})
 		return
 	}
 
@@ -594,7 +741,7 @@ func (this *fileSystem) actionParent(p *InPacket, req *FsRequest) {
 		this.replyToPacket(p, req, 0, 0, []byte{})
 	} else {
 		parentPath := filepath.Dir(path)
-		l, code := this.createLock(parentPath, SHARED_LOCK)
+		l, code := this.createLock(req, parentPath, SHARED_LOCK)
 		if l == nil {
 			this.replyToPacket(p, req, DOS_FALSE, code, []byte{})
 		} else {
@@ -617,7 +764,7 @@ func (this *fileSystem) actionRead(p *InPacket, req *FsRequest) {
 		return
 	}
 
-	fmt.Printf("Read up to %d bytes\n", bytesToRead)
+	this.log.Debug("Read", "path", fh.path, "bytes", bytesToRead)
 	status := int32(0)
 
 	for bytesToRead > 0 && status == 0 {
@@ -630,7 +777,7 @@ func (this *fileSystem) actionRead(p *InPacket, req *FsRequest) {
 
 		bytesRead, err := fh.fh.Read(data)
 		if err != nil && err != io.EOF {
-			this.replyToPacket(p, req, -1, translateError(err), []byte{})
+			this.replyToPacket(p, req, -1, this.errorCode(req, err), []byte{})
 			return
 		}
 
@@ -653,21 +800,18 @@ func (this *fileSystem) actionWrite(p *InPacket, req *FsRequest) {
 	bytesToWrite := req.arg4
 	bytesRemaining := req.arg3
 
-	fmt.Printf("Write %d bytes. %d remaining\n", bytesToWrite, bytesRemaining)
-
 	data := req.getBytes(0, bytesToWrite)
 
-	fmt.Printf("%d bytes in packet\n", len(data))
+	this.log.Debug("Write", "path", fh.path, "bytes", len(data), "remaining", bytesRemaining)
 
 	bytesWritten, err := fh.fh.Write(data)
 	if err != nil {
-		fmt.Printf("Write failed: %s\n", err.Error())
-		this.replyToPacket(p, req, -1, translateError(err), []byte{})
+		this.log.Warn("Write failed", "path", fh.path, "err", err)
+		this.replyToPacket(p, req, -1, this.errorCode(req, err), []byte{})
 	}
 
 	status := int32(0)
 	if bytesRemaining == 0 {
-		fmt.Printf("No more data expected\n")
 		status = -1
 	}
 
@@ -681,16 +825,15 @@ func (this *fileSystem) actionCreateDir(p *InPacket, req *FsRequest) {
 
 	err := os.Mkdir(path, 0755)
 	if err != nil {
-		fmt.Printf("Error creating dir %s: %s\n", path, err.Error())
-		this.replyToPacket(p, req, DOS_FALSE, translateError(err), []byte{})
+		this.replyToPacket(p, req, DOS_FALSE, this.errorCode(req, err), []byte{})
 	}
 
-	l, code := this.createLock(path, SHARED_LOCK)
+	l, code := this.createLock(req, path, SHARED_LOCK)
 
 	if l == nil {
 		this.replyToPacket(p, req, DOS_FALSE, code, []byte{})
 	} else {
-		fmt.Printf("Create dir %s\n", path)
+		this.log.Debug("Create dir", "path", path)
 		this.replyToPacket(p, req, l.id, 0, []byte{})
 	}
 }
@@ -701,9 +844,9 @@ func (this *fileSystem) actionDeleteObject(p *InPacket, req *FsRequest) {
 
 	err := os.Remove(path)
 	if err != nil {
-		this.replyToPacket(p, req, DOS_FALSE, translateError(err), []byte{})
+		this.replyToPacket(p, req, DOS_FALSE, this.errorCode(req, err), []byte{})
 	} else {
-		fmt.Printf("Delete %s\n", path)
+		this.log.Debug("Delete", "path", path)
 		this.replyToPacket(p, req, DOS_TRUE, 0, []byte{})
 	}
 }
@@ -718,9 +861,9 @@ func (this *fileSystem) actionRenameObject(p *InPacket, req *FsRequest) {
 	err := os.Rename(path1, path2)
 
 	if err != nil {
-		this.replyToPacket(p, req, DOS_FALSE, translateError(err), []byte{})
+		this.replyToPacket(p, req, DOS_FALSE, this.errorCode(req, err), []byte{})
 	} else {
-		fmt.Printf("Rename %s to %s\n", path1, path2)
+		this.log.Debug("Rename", "from", path1, "to", path2)
 		this.replyToPacket(p, req, DOS_TRUE, 0, []byte{})
 	}
 }
@@ -735,7 +878,7 @@ func (this *fileSystem) actionSeek(p *InPacket, req *FsRequest) {
 
 	oldPos, err := fh.fh.Seek(0, io.SeekCurrent)
 	if err != nil {
-		this.replyToPacket(p, req, -1, translateError(err), []byte{})
+		this.replyToPacket(p, req, -1, this.errorCode(req, err), []byte{})
 		return
 	}
 
@@ -751,7 +894,7 @@ func (this *fileSystem) actionSeek(p *InPacket, req *FsRequest) {
 
 	_, err = fh.fh.Seek(int64(req.arg2), whence)
 	if err != nil {
-		this.replyToPacket(p, req, -1, translateError(err), []byte{})
+		this.replyToPacket(p, req, -1, this.errorCode(req, err), []byte{})
 		return
 	}
 
@@ -769,7 +912,7 @@ func (this *fileSystem) actionParentFh(p *InPacket, req *FsRequest) {
 	path := this.resolvePath(req.arg2, "")
 	parentPath := filepath.Dir(path)
 
-	l, code := this.createLock(parentPath, req.arg3)
+	l, code := this.createLock(req, parentPath, req.arg3)
 
 	if l == nil {
 		this.replyToPacket(p, req, DOS_FALSE, code, []byte{})
@@ -883,14 +1026,22 @@ func (this *FsHandler) HandlePacket(p *InPacket) {
 	ix += 2
 	req.strData = p.Data[ix:]
 
+	this.lock.Lock()
+	defer this.unlock()
+
+	start := time.Now()
+	defer func() {
+		this.actionTime.With(fsActionName(req.reqType)).Observe(time.Since(start).Seconds())
+	}()
+
 	fs := this.fileSystems[req.volId]
 	if fs == nil {
-		replyToPacket(this.outChan, p, req, DOS_FALSE, ERROR_DEVICE_NOT_MOUNTED, []byte{})
+		replyToPacket(&this.outbox, p, req, DOS_FALSE, ERROR_DEVICE_NOT_MOUNTED, []byte{})
 		return
 	}
 
 	if !fs.isMounted {
-		replyToPacket(this.outChan, p, req, DOS_FALSE, ERROR_DEVICE_NOT_MOUNTED, []byte{})
+		replyToPacket(&this.outbox, p, req, DOS_FALSE, ERROR_DEVICE_NOT_MOUNTED, []byte{})
 		return
 	}
 
@@ -941,9 +1092,61 @@ func (this *FsHandler) HandlePacket(p *InPacket) {
 }
 
 func (this *FsHandler) Quit() {
-	this.quitChan <- true
+	close(this.quitChan)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, fs := range this.fileSystems {
+		fs.closeFiles()
+	}
+}
+
+// AdminCommand lists the volumes or rescans the mount path.
+func (this *FsHandler) AdminCommand(cmd string, w io.Writer) (handled bool) {
+
+	if cmd != "volumes" && cmd != "rescan" {
+		return false
+	}
+
+	this.lock.Lock()
+	defer this.unlock()
+
+	if this.fileSystems == nil {
+		fmt.Fprintf(w, "not started\n")
+		return true
+	}
+
+	if cmd == "rescan" {
+		this.checkMountedVolumes()
+	}
+
+	ids := make([]int, 0, len(this.fileSystems))
+	for id := range this.fileSystems {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	fmt.Fprintf(w, "ID\tNAME\tPATH\tSTATE\tLOCKS\tFILES\n")
+	for _, id := range ids {
+		fs := this.fileSystems[uint16(id)]
+		state := "unmounted"
+		if fs.isMounted {
+			state = "mounted"
+		}
+		if fs.isDefault {
+			state += ",default"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\n", fs.id, fs.name, fs.rootPath, state, len(fs.locks), len(fs.files))
+	}
+
+	return true
 }
 
-func NewFsHandler() Handler {
-	return &FsHandler{}
+func NewFsHandler(config FsConfig) Handler {
+	return &FsHandler{
+		config:     config,
+		actionTime: DefaultRegistry.Histogram("amipiborg_fs_action_seconds", "Time taken to answer FS requests.", []float64{.0005, .001, .005, .01, .05, .1, .5, 1}, "action"),
+		volumes:    DefaultRegistry.Gauge("amipiborg_fs_volumes", "Volumes mounted for the Amiga.").With(),
+		log:        subsystemLogger("fs")}
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fsRequest lays out a request the way the Amiga's handler sends it.
+func fsRequest(reqId uint32, reqType uint16, args [4]int32, strData []byte) []byte {
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, reqId)
+	binary.Write(buf, binary.BigEndian, args)
+	binary.Write(buf, binary.BigEndian, uint16(0))
+	binary.Write(buf, binary.BigEndian, reqType)
+	binary.Write(buf, binary.BigEndian, uint16(len(strData)))
+	buf.Write(strData)
+
+	return buf.Bytes()
+}
+
+// bstr is an Amiga style string, its length first.
+func bstr(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+// expectReply waits for the answer to reqId and returns its two results.
+func expectReply(t *testing.T, amiga *FakeAmiga, connId uint16, reqId uint32) (res1 int32, res2 int32) {
+
+	for {
+		p, err := amiga.Expect(connId, MT_Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if binary.BigEndian.Uint32(p.Data) == reqId {
+			return int32(binary.BigEndian.Uint32(p.Data[4:])), int32(binary.BigEndian.Uint32(p.Data[8:]))
+		}
+	}
+}
+
+func startFsServer(t *testing.T) (srv *Server, amiga *FakeAmiga, dir string) {
+
+	dir = t.TempDir()
+	mnt := filepath.Join(dir, "media")
+	os.Mkdir(mnt, 0755)
+
+	srv, amiga = startServer(t, func(srv *Server, hf *HandlerFactory) {
+		hf.RegisterHandler(HandlerInfo{Id: HT_FS, Name: HN_FS, Version: 1}, func() Handler {
+			return NewFsHandler(FsConfig{DefaultName: "Pi", DefaultPath: dir, MountPath: mnt})
+		})
+	})
+
+	return srv, amiga, dir
+}
+
+func TestFsAdminDuringBigRead(t *testing.T) {
+
+	srv, amiga, dir := startFsServer(t)
+	os.WriteFile(filepath.Join(dir, "big"), make([]byte, 1024*1024), 0644)
+
+	var silent atomic.Bool
+	amiga.WindowSize = 4
+	amiga.DropIncoming = func(p *InPacket) bool {
+		return silent.Load()
+	}
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(4, HT_FS); err != nil {
+		t.Fatal(err)
+	}
+
+	amiga.WritePacket(4, MT_Data, fsRequest(1, PT_ACTION_FIND_INPUT, [4]int32{0, 0, 0, 0}, bstr("big")))
+	res1, fh := expectReply(t, amiga, 4, 1)
+	if res1 != DOS_TRUE {
+		t.Fatalf("open failed with %d", fh)
+	}
+
+	// More than the handler's channel holds, and the Amiga stops taking it.
+	silent.Store(true)
+	amiga.WritePacket(4, MT_Data, fsRequest(2, PT_ACTION_READ, [4]int32{fh, 0, 1024 * 1024, 0}, nil))
+	time.Sleep(300 * time.Millisecond)
+
+	done := make(chan string, 1)
+	go func() {
+		text, _ := srv.Admin([]string{"volumes"})
+		done <- text
+	}()
+
+	select {
+	case text := <-done:
+		if !strings.Contains(text, "mounted,default") {
+			t.Fatalf("volumes:\n%s", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("admin stuck behind the read")
+	}
+
+	silent.Store(false)
+}
+
+func TestTranslateError(t *testing.T) {
+
+	dir := t.TempDir()
+
+	_, err := os.Open(filepath.Join(dir, "nope"))
+	if code, exact := translateError(err, PT_ACTION_FIND_INPUT); code != ERROR_OBJECT_NOT_FOUND || !exact {
+		t.Fatal(code, err)
+	}
+
+	os.Mkdir(filepath.Join(dir, "d"), 0755)
+	os.WriteFile(filepath.Join(dir, "d", "f"), nil, 0644)
+	err = os.Remove(filepath.Join(dir, "d"))
+	if code, exact := translateError(err, PT_ACTION_DELETE_OBJECT); code != ERROR_DIRECTORY_NOT_EMPTY || !exact {
+		t.Fatal(code, err)
+	}
+
+	// Which protection was in the way depends on what was asked for.
+	denied := &os.PathError{Op: "open", Path: "f", Err: syscall.EACCES}
+	for reqType, want := range map[uint16]int32{
+		PT_ACTION_FIND_INPUT:    ERROR_READ_PROTECTED,
+		PT_ACTION_READ:          ERROR_READ_PROTECTED,
+		PT_ACTION_LOCATE_OBJECT: ERROR_READ_PROTECTED,
+		PT_ACTION_FIND_OUTPUT:   ERROR_WRITE_PROTECTED,
+		PT_ACTION_WRITE:         ERROR_WRITE_PROTECTED,
+		PT_ACTION_DELETE_OBJECT: ERROR_DELETE_PROTECTED} {
+		if code, _ := translateError(denied, reqType); code != want {
+			t.Errorf("%s: got %d, want %d", fsActionName(reqType), code, want)
+		}
+	}
+
+	if _, exact := translateError(os.ErrClosed, PT_ACTION_READ); exact {
+		t.Fatal("no AmigaDOS error should fit a closed file")
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
 	"sort"
 )
 
@@ -11,9 +16,45 @@ const (
 	HT_FS    = 4
 )
 
+// Names of the built in handlers, as offered in MT_Hello and picked with
+// -handlers.
+const (
+	HN_Ping  = "PING"
+	HN_Date  = "DATE"
+	HN_Input = "INPUT"
+	HN_FS    = "FS"
+)
+
+var handlerNames = []string{HN_Ping, HN_Date, HN_Input, HN_FS}
+
+const (
+	// Only one connection to the handler makes sense at a time.
+	HF_Exclusive = 0x00000001
+	// The handler sends data without being asked.
+	HF_Notifies = 0x00000002
+	// Latency matters more than throughput, the server sends its packets first.
+	HF_Interactive = 0x00000004
+)
+
+const (
+	// Version 1 clients expect names in a fixed 10 byte field, zero
+	// terminated.
+	LegacyNameLength = 10
+	MaxNameLength    = 255
+)
+
+// HandlerInfo describes a handler to the Amiga in MT_Hello.
+type HandlerInfo struct {
+	Id          uint16
+	Name        string
+	Version     uint16
+	Flags       uint32
+	Description string
+}
+
 type handlerDesc struct {
-	name    string
-	builder (func() Handler)
+	info    HandlerInfo
+	builder (func() ContextHandler)
 }
 
 type HandlerFactory struct {
@@ -26,10 +67,29 @@ func NewHandlerFactory() (hf *HandlerFactory) {
 }
 
 func (this *HandlerFactory) AddHandler(handlerId uint16, name string, builder func() Handler) {
-	this.handlers[handlerId] = &handlerDesc{name, builder}
+	this.RegisterHandler(HandlerInfo{Id: handlerId, Name: name, Version: 1}, builder)
 }
 
-func (this *HandlerFactory) CreateHandler(handlerId uint16) Handler {
+func (this *HandlerFactory) AddContextHandler(handlerId uint16, name string, builder func() ContextHandler) {
+	this.RegisterContextHandler(HandlerInfo{Id: handlerId, Name: name, Version: 1}, builder)
+}
+
+// RegisterHandler adds a handler written against the original Handler
+// interface.
+func (this *HandlerFactory) RegisterHandler(info HandlerInfo, builder func() Handler) {
+	this.RegisterContextHandler(info, LegacyHandler(builder))
+}
+
+func (this *HandlerFactory) RegisterContextHandler(info HandlerInfo, builder func() ContextHandler) {
+
+	if len(info.Name) >= LegacyNameLength {
+		subsystemLogger("server").Warn("Handler name will be cut for old clients", "handler", info.Name, "length", LegacyNameLength-1)
+	}
+
+	this.handlers[info.Id] = &handlerDesc{info, builder}
+}
+
+func (this *HandlerFactory) CreateHandler(handlerId uint16) ContextHandler {
 	if hd, ok := this.handlers[handlerId]; ok {
 		return hd.builder()
 	}
@@ -40,7 +100,15 @@ func (this *HandlerFactory) HandlerCount() uint16 {
 	return uint16(len(this.handlers))
 }
 
-func (this *HandlerFactory) GetHandlerDescriptions() ([]uint16, []string) {
+func (this *HandlerFactory) GetHandlerInfoById(handlerId uint16) (info HandlerInfo, ok bool) {
+	if hd, ok := this.handlers[handlerId]; ok {
+		return hd.info, true
+	}
+	return info, false
+}
+
+// GetHandlerInfo returns the registered handlers ordered by id.
+func (this *HandlerFactory) GetHandlerInfo() []HandlerInfo {
 
 	iids := make([]int, 0, len(this.handlers))
 	for iid := range this.handlers {
@@ -49,18 +117,151 @@ func (this *HandlerFactory) GetHandlerDescriptions() ([]uint16, []string) {
 
 	sort.Ints(iids)
 
-	ids := make([]uint16, 0, len(this.handlers))
-	names := make([]string, 0, len(this.handlers))
+	infos := make([]HandlerInfo, 0, len(this.handlers))
 	for _, id := range iids {
-		ids = append(ids, uint16(id))
-		names = append(names, this.handlers[uint16(id)].name)
+		infos = append(infos, this.handlers[uint16(id)].info)
+	}
+
+	return infos
+}
+
+// Writes the descriptor the way version 1 clients read it, the id followed
+// by the name in a zero padded 10 byte field. There is always at least one
+// zero, longer names are cut.
+func (this HandlerInfo) encodeLegacy(buf *bytes.Buffer) {
+
+	binary.Write(buf, binary.BigEndian, this.Id)
+
+	name := []byte(this.Name)
+	if len(name) >= LegacyNameLength {
+		name = name[:LegacyNameLength-1]
 	}
+	buf.Write(name)
+	buf.Write(make([]byte, LegacyNameLength-len(name)))
+}
+
+// Writes the full descriptor:
+//
+//	uint16 id
+//	uint16 version
+//	uint32 flags
+//	uint8  name length, name
+//	uint8  description length, description
+func (this HandlerInfo) encode(buf *bytes.Buffer) {
 
-	return ids, names
+	binary.Write(buf, binary.BigEndian, this.Id)
+	binary.Write(buf, binary.BigEndian, this.Version)
+	binary.Write(buf, binary.BigEndian, this.Flags)
+	writeShortString(buf, this.Name)
+	writeShortString(buf, this.Description)
 }
 
+func decodeHandlerInfo(buf *bytes.Reader) (info HandlerInfo, err error) {
+
+	if err = binary.Read(buf, binary.BigEndian, &info.Id); err != nil {
+		return info, err
+	}
+	if err = binary.Read(buf, binary.BigEndian, &info.Version); err != nil {
+		return info, err
+	}
+	if err = binary.Read(buf, binary.BigEndian, &info.Flags); err != nil {
+		return info, err
+	}
+	if info.Name, err = readShortString(buf); err != nil {
+		return info, err
+	}
+	info.Description, err = readShortString(buf)
+	return info, err
+}
+
+func writeShortString(buf *bytes.Buffer, s string) {
+
+	if len(s) > MaxNameLength {
+		s = s[:MaxNameLength]
+	}
+	buf.WriteByte(uint8(len(s)))
+	buf.WriteString(s)
+}
+
+func readShortString(buf *bytes.Reader) (s string, err error) {
+
+	l, err := buf.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, l)
+	if _, err = io.ReadFull(buf, b); err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// Handler is the original handler interface. New handlers should
+// implement ContextHandler instead.
 type Handler interface {
 	Init(outChan chan *OutPacket)
 	Quit()
 	HandlePacket(p *InPacket)
 }
+
+// ContextHandler serves one connection. Serve is started when the Amiga
+// connects and should return once ctx is cancelled, which happens when the
+// connection is closed from either end.
+type ContextHandler interface {
+	Serve(ctx context.Context, conn *HandlerConn) error
+}
+
+// legacyHandler runs a Handler as a ContextHandler.
+type legacyHandler struct {
+	handler Handler
+}
+
+// LegacyHandler adapts a Handler builder for RegisterContextHandler.
+func LegacyHandler(builder func() Handler) func() ContextHandler {
+	return func() ContextHandler {
+		return &legacyHandler{builder()}
+	}
+}
+
+// AdminHandler is implemented by handlers that answer commands from the
+// admin socket. AdminCommand is called from the admin socket's goroutine
+// while the handler runs, so it must do its own locking. It returns false
+// for commands it doesn't know.
+type AdminHandler interface {
+	AdminCommand(cmd string, w io.Writer) (handled bool)
+}
+
+func (this *legacyHandler) AdminCommand(cmd string, w io.Writer) (handled bool) {
+
+	if ah, ok := this.handler.(AdminHandler); ok {
+		return ah.AdminCommand(cmd, w)
+	}
+	return false
+}
+
+// LoggingHandler is implemented by Handlers that want a logger tagged with
+// their connection before Init is called.
+type LoggingHandler interface {
+	SetLogger(log *slog.Logger)
+}
+
+func (this *legacyHandler) Serve(ctx context.Context, conn *HandlerConn) error {
+
+	if lh, ok := this.handler.(LoggingHandler); ok {
+		lh.SetLogger(conn.Logger())
+	}
+
+	this.handler.Init(conn.outChan)
+
+	for {
+		select {
+		case p := <-conn.Packets():
+			this.handler.HandlePacket(p)
+		case <-ctx.Done():
+			this.handler.Quit()
+			return nil
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// captureLog sends the default logger to a buffer until the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+
+	buf := new(bytes.Buffer)
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	return buf
+}
+
+func TestLegacyHello(t *testing.T) {
+
+	// The name and at least one zero in 10 bytes.
+	tests := []struct {
+		name string
+		want string
+		warn bool
+	}{
+		{"", "", false},
+		{"PING", "PING", false},
+		{"NINELETRS", "NINELETRS", false},
+		{"TENLETTERS", "TENLETTER", true},
+		{"FIFTEENLETTERS!", "FIFTEENLE", true}}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		HandlerInfo{Id: 0x1234, Name: test.name, Version: 3, Flags: HF_Notifies, Description: "ignored"}.encodeLegacy(buf)
+
+		b := buf.Bytes()
+		if len(b) != 2+LegacyNameLength || binary.BigEndian.Uint16(b) != 0x1234 {
+			t.Fatalf("%q: encoded as %v", test.name, b)
+		}
+		if b[len(b)-1] != 0 {
+			t.Errorf("%q: name not zero terminated", test.name)
+		}
+		if name := string(bytes.TrimRight(b[2:], "\x00")); name != test.want {
+			t.Errorf("%q: name %q, want %q", test.name, name, test.want)
+		}
+
+		log := captureLog(t)
+		NewHandlerFactory().AddContextHandler(0x1234, test.name, NewPingHandler)
+		if warned := strings.Contains(log.String(), "will be cut"); warned != test.warn {
+			t.Errorf("%q: warned %v, want %v", test.name, warned, test.warn)
+		}
+	}
+
+	_, amiga := startServer(t, func(srv *Server, hf *HandlerFactory) {
+		hf.AddContextHandler(0x77, "TENLETTERS", NewPingHandler)
+	})
+	amiga.Version = 1
+
+	_, handlers, err := amiga.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(handlers) != 2 || handlers[HT_Ping] != "PING" || handlers[0x77] != "TENLETTER" {
+		t.Fatalf("handlers %v", handlers)
+	}
+}
+
+func TestHandlerInfoHello(t *testing.T) {
+
+	infos := []HandlerInfo{
+		{HT_Ping, "PING", 1, 0, ""},
+		{0x77, "A handler with a long name", 3, HF_Exclusive | HF_Interactive, "Does things"},
+		{0x78, strings.Repeat("N", MaxNameLength), 1, HF_Notifies, strings.Repeat("D", MaxNameLength)}}
+
+	// Layout of the full descriptor.
+	buf := new(bytes.Buffer)
+	infos[1].encode(buf)
+	want := []byte{0x00, 0x77, 0x00, 0x03, 0x00, 0x00, 0x00, 0x05, 26}
+	want = append(want, "A handler with a long name"...)
+	want = append(want, 11)
+	want = append(want, "Does things"...)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("encoded as %v, want %v", buf.Bytes(), want)
+	}
+
+	_, amiga := startServer(t, func(srv *Server, hf *HandlerFactory) {
+		for _, info := range infos[1:] {
+			hf.RegisterContextHandler(info, NewPingHandler)
+		}
+	})
+	amiga.HandlerInfo = true
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if len(amiga.Handlers) != len(infos) {
+		t.Fatalf("handlers %v", amiga.Handlers)
+	}
+	for ix, info := range infos {
+		if amiga.Handlers[ix] != info {
+			t.Errorf("got %+v, want %+v", amiga.Handlers[ix], info)
+		}
+	}
+
+	// A descriptor cut short is an error.
+	if _, err := decodeHandlerInfo(bytes.NewReader(want[:len(want)-1])); err == nil {
+		t.Fatal("truncated descriptor decoded")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// What the Amiga asked for in MT_Init.
+//
+// Version 1 clients send an empty MT_Init. Later clients send
+//
+//	uint16 protocol version
+//	uint32 capabilities
+//	uint16 window size
+type clientInit struct {
+	version uint16
+	caps    uint32
+	window  uint16
+}
+
+// What both sides agreed on, confirmed to the Amiga in MT_Hello.
+type session struct {
+	version uint16
+	caps    uint32
+	window  uint16
+}
+
+func parseInit(data []byte) (ci clientInit, err error) {
+
+	if len(data) == 0 {
+		return clientInit{version: 1}, nil
+	}
+
+	if len(data) < 8 {
+		return ci, fmt.Errorf("short MT_Init, %d bytes", len(data))
+	}
+
+	ci.version = binary.BigEndian.Uint16(data)
+	ci.caps = binary.BigEndian.Uint32(data[2:])
+	ci.window = binary.BigEndian.Uint16(data[6:])
+
+	return ci, nil
+}
+
+func (this clientInit) encode() []byte {
+
+	if this.version < 2 {
+		return []byte{}
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, this.version)
+	binary.Write(buf, binary.BigEndian, this.caps)
+	binary.Write(buf, binary.BigEndian, this.window)
+
+	return buf.Bytes()
+}
+
+// negotiate settles on the highest protocol version both sides speak and
+// the capabilities both support. Clients older than the oldest version we
+// still speak are refused.
+func negotiate(ci clientInit, serverCaps uint32) (s session, err error) {
+
+	if ci.version < AMIPIBORG_MIN_VERSION {
+		return s, fmt.Errorf("client protocol version %d is older than %d", ci.version, AMIPIBORG_MIN_VERSION)
+	}
+
+	s.version = ci.version
+	if s.version > AMIPIBORG_VERSION {
+		s.version = AMIPIBORG_VERSION
+	}
+
+	// Version 1 has no capabilities at all.
+	if s.version < 2 {
+		return s, nil
+	}
+
+	s.caps = ci.caps & serverCaps
+
+	if s.caps&CAP_Window != 0 {
+		s.window = ci.window
+		if s.window > MaxWindowSize {
+			s.window = MaxWindowSize
+		}
+		if s.window == 0 {
+			s.caps &^= CAP_Window
+		}
+	}
+
+	return s, nil
+}
+
+// The part of MT_Hello between the server version and the handler list.
+// Version 1 clients don't expect anything there.
+func (this session) encode(buf *bytes.Buffer) {
+
+	if this.version < 2 {
+		return
+	}
+
+	binary.Write(buf, binary.BigEndian, this.version)
+	binary.Write(buf, binary.BigEndian, this.caps)
+	binary.Write(buf, binary.BigEndian, this.window)
+}
+
+func (this session) has(cap uint32) bool {
+	return this.caps&cap == cap
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
 	"github.com/gvalkov/golang-evdev"
+	"log/slog"
 	"time"
 )
 
@@ -149,13 +149,20 @@ var keyTempQualifiers map[uint16]uint16 = map[uint16]uint16{
 type InputHandler struct {
 	outChan  chan *OutPacket
 	ctrlChan chan bool
+	quitChan chan bool
 	devices  []*evdev.InputDevice
 	running  bool
+	log      *slog.Logger
+}
+
+func (this *InputHandler) SetLogger(log *slog.Logger) {
+	this.log = log
 }
 
 func (this *InputHandler) Init(outChan chan *OutPacket) {
 	this.outChan = outChan
 	this.ctrlChan = make(chan bool)
+	this.quitChan = make(chan bool)
 	this.devices = make([]*evdev.InputDevice, 1)
 
 	this.openInputDevices()
@@ -174,7 +181,7 @@ func (this *InputHandler) openInputDevices() {
 
 	paths, err := evdev.ListInputDevicePaths("/dev/input/event*")
 	if err != nil {
-		fmt.Println(err.Error())
+		this.log.Error("Unable to list input devices", "err", err)
 		return
 	}
 	for _, path := range paths {
@@ -182,46 +189,48 @@ func (this *InputHandler) openInputDevices() {
 
 			dev, err := evdev.Open(path)
 			if err != nil {
-				fmt.Printf("Can't open %s\n", path)
+				this.log.Warn("Can't open input device", "path", path, "err", err)
 				continue
 			}
 
-			fmt.Println(dev)
+			this.log.Debug("Input device", "path", path, "name", dev.Name)
 
 			isMouse := true
 			isKeyboard := true
 
 			cap := dev.Capabilities[evdev.CapabilityType{evdev.EV_REL, evdev.EV[evdev.EV_REL]}]
 			if cap == nil {
-				fmt.Printf("%s has no EV_REL capability\n", path)
+				this.log.Debug("No EV_REL capability", "path", path)
 				isMouse = false
 			}
 
 			cap = dev.Capabilities[evdev.CapabilityType{evdev.EV_KEY, evdev.EV[evdev.EV_KEY]}]
 			if cap == nil {
-				fmt.Printf("%s has no EV_KEY capability\n", path)
+				this.log.Debug("No EV_KEY capability", "path", path)
 				isMouse = false
 				isKeyboard = false
 			}
 
 			if !hasEventCode(cap, evdev.BTN_LEFT) {
-				fmt.Printf("%s has no BTN_LEFT code\n", path)
+				this.log.Debug("No BTN_LEFT code", "path", path)
 				isMouse = false
 			}
 
 			if !hasEventCode(cap, evdev.BTN_RIGHT) {
-				fmt.Printf("%s has no BTN_RIGHT code\n", path)
+				this.log.Debug("No BTN_RIGHT code", "path", path)
 				isMouse = false
 			}
 
 			if isMouse {
-				fmt.Printf("%s looks like a mouse.\n", path)
+				this.log.Info("Found mouse", "path", path, "name", dev.Name)
 
 				this.devices = append(this.devices, dev)
 			} else if isKeyboard {
-				fmt.Printf("%s looks like a keyboard.\n", path)
+				this.log.Info("Found keyboard", "path", path, "name", dev.Name)
 
 				this.devices = append(this.devices, dev)
+			} else {
+				dev.File.Close()
 			}
 		}
 	}
@@ -242,13 +251,21 @@ func (this *InputHandler) Run() {
 			if d.Grab() == nil {
 				defer d.Release()
 			}
-			for !done {
+			for {
 				e, err := d.ReadOne()
 				if err != nil {
-					fmt.Println(err.Error())
+					// Expected once Quit has closed the device.
+					select {
+					case <-this.quitChan:
+					default:
+						this.log.Error("Reading input device failed", "path", d.Fn, "err", err)
+					}
+					return
 				}
-				if e != nil {
-					eventReader <- e
+				select {
+				case eventReader <- e:
+				case <-this.quitChan:
+					return
 				}
 			}
 		}(dev)
@@ -291,9 +308,7 @@ func (this *InputHandler) Run() {
 
 					binary.Write(buf, binary.BigEndian, uint16(mousebtn))
 					binary.Write(buf, binary.BigEndian, btn)
-					this.outChan <- &OutPacket{
-						PacketType: MT_Data,
-						Data:       buf.Bytes()}
+					done = !this.send(buf.Bytes())
 				} else {
 
 					key, ok := keyMap[c]
@@ -312,9 +327,7 @@ func (this *InputHandler) Run() {
 						binary.Write(buf, binary.BigEndian, uint16(keyboard))
 						binary.Write(buf, binary.BigEndian, key)
 						binary.Write(buf, binary.BigEndian, currQual|keyTempQualifiers[c]|capsLock)
-						this.outChan <- &OutPacket{
-							PacketType: MT_Data,
-							Data:       buf.Bytes()}
+						done = !this.send(buf.Bytes())
 
 					}
 				}
@@ -331,9 +344,7 @@ func (this *InputHandler) Run() {
 				dx = 0
 				dy = 0
 
-				this.outChan <- &OutPacket{
-					PacketType: MT_Data,
-					Data:       buf.Bytes()}
+				done = !this.send(buf.Bytes())
 			}
 		case done = <-this.ctrlChan:
 		}
@@ -342,16 +353,49 @@ func (this *InputHandler) Run() {
 	ticker.Stop()
 }
 
+// send passes an event on to the Amiga. It gives up and returns false when
+// Quit asks Run to stop, the server may not be taking packets any more.
+func (this *InputHandler) send(data []byte) bool {
+
+	select {
+	case this.outChan <- &OutPacket{PacketType: MT_Data, Data: data}:
+		return true
+	case <-this.ctrlChan:
+		return false
+	}
+}
+
+// Quit stops forwarding events and releases the devices so the Pi gets its
+// keyboard and mouse back.
 func (this *InputHandler) Quit() {
-	this.ctrlChan <- true
+
+	if this.running {
+		this.ctrlChan <- true
+		this.running = false
+	}
+
+	close(this.quitChan)
+
+	for _, dev := range this.devices {
+		if dev == nil {
+			continue
+		}
+		dev.Release()
+		dev.File.Close()
+	}
+	this.devices = nil
 }
 
 func (this *InputHandler) HandlePacket(p *InPacket) {
 
+	if this.running {
+		return
+	}
+
 	this.running = true
 	go this.Run()
 }
 
 func NewInputHandler() Handler {
-	return &InputHandler{}
+	return &InputHandler{log: subsystemLogger("input")}
 }
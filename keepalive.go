@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// How long the link may be quiet before the Amiga is pinged.
+	DefaultKeepaliveInterval = 10 * time.Second
+
+	// Pings that go unanswered before the Amiga is taken for gone.
+	DefaultKeepaliveMisses = 3
+)
+
+// keepalive decides when to ping a quiet Amiga and when to give up on it.
+// Anything heard from the Amiga counts as an answer, not just MT_Pong.
+type keepalive struct {
+	interval  time.Duration
+	misses    int
+	lastHeard time.Time
+	lastPing  time.Time
+	missed    int
+}
+
+// newKeepalive pings after interval of silence. An interval of 0 never
+// pings.
+func newKeepalive(interval time.Duration, misses int) *keepalive {
+
+	return &keepalive{
+		interval: interval,
+		misses:   misses}
+}
+
+func (this *keepalive) enabled() bool {
+	return this.interval > 0
+}
+
+// heard notes that the Amiga is still there.
+func (this *keepalive) heard(now time.Time) {
+	this.lastHeard = now
+	this.missed = 0
+}
+
+// check returns whether a ping is due, or whether so many went unanswered
+// that the Amiga is gone.
+func (this *keepalive) check(now time.Time) (ping bool, dead bool) {
+
+	if !this.enabled() || now.Sub(this.lastHeard) < this.interval || now.Sub(this.lastPing) < this.interval {
+		return false, false
+	}
+
+	if this.missed >= this.misses {
+		return false, true
+	}
+
+	this.lastPing = now
+	this.missed++
+
+	return true, false
+}
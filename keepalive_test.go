@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveCheck(t *testing.T) {
+
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	k := newKeepalive(time.Second, 2)
+	k.heard(start)
+
+	steps := []struct {
+		ms   int
+		ping bool
+		dead bool
+	}{
+		{500, false, false},
+		{1000, true, false},
+		{1500, false, false},
+		{2000, true, false},
+		{2500, false, false},
+		{3000, false, true}}
+
+	for _, s := range steps {
+		if ping, dead := k.check(at(s.ms)); ping != s.ping || dead != s.dead {
+			t.Fatalf("at %dms: ping %v dead %v, want %v %v", s.ms, ping, dead, s.ping, s.dead)
+		}
+	}
+
+	// Hearing anything starts over.
+	k.heard(at(3000))
+	if ping, dead := k.check(at(3500)); ping || dead {
+		t.Fatal("pinged right after hearing from the Amiga")
+	}
+	if ping, _ := k.check(at(4000)); !ping || k.missed != 1 {
+		t.Fatal("misses not reset", k.missed)
+	}
+
+	if ping, dead := newKeepalive(0, 1).check(at(3600 * 1000)); ping || dead {
+		t.Fatal("a keepalive of 0 pinged")
+	}
+}
+
+// waitHandler does nothing until its connection is closed.
+type waitHandler struct {
+	closed chan bool
+}
+
+func (this waitHandler) Serve(ctx context.Context, conn *HandlerConn) error {
+
+	<-ctx.Done()
+	this.closed <- true
+
+	return nil
+}
+
+func TestKeepaliveDeadPeer(t *testing.T) {
+
+	closed := make(chan bool, 1)
+	_, amiga := startServer(t, func(srv *Server, hf *HandlerFactory) {
+		srv.SetKeepalive(50*time.Millisecond, 2)
+		hf.AddContextHandler(9, "WAIT", func() ContextHandler { return waitHandler{closed} })
+	})
+	amiga.Keepalive = true
+	amiga.WindowSize = 4
+
+	// The Amiga is switched off, it hears nothing and says nothing.
+	var pings atomic.Int32
+	var silent atomic.Bool
+	amiga.DropIncoming = func(p *InPacket) bool {
+		if p.PacketType == MT_Ping {
+			pings.Add(1)
+		}
+		return silent.Load()
+	}
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(3, 9); err != nil {
+		t.Fatal(err)
+	}
+
+	silent.Store(true)
+	time.Sleep(400 * time.Millisecond)
+	silent.Store(false)
+
+	if n := pings.Load(); n != 2 {
+		t.Fatalf("%d pings, want 2", n)
+	}
+
+	// The session was dropped with its connections, the Amiga has to
+	// start again.
+	select {
+	case <-closed:
+	default:
+		t.Fatal("connection still open")
+	}
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+}
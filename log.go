@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	LF_Text     = "text"
+	LF_JSON     = "json"
+	LF_Journald = "journald"
+)
+
+type LogConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+func parseLevel(name string) (level slog.Level, err error) {
+
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+
+	return level, fmt.Errorf("unknown log level \"%s\"", name)
+}
+
+// NewLogger builds the logger described by cfg, writing to w.
+func NewLogger(cfg LogConfig, w io.Writer) (log *slog.Logger, err error) {
+
+	level, err := parseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch cfg.Format {
+	case "", LF_Text:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case LF_JSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case LF_Journald:
+		return slog.New(newJournaldHandler(w, level)), nil
+	}
+
+	return nil, fmt.Errorf("unknown log format \"%s\"", cfg.Format)
+}
+
+// SetupLogging makes the configured logger the default for every
+// subsystem created afterwards.
+func SetupLogging(cfg LogConfig) (err error) {
+
+	log, err := NewLogger(cfg, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(log)
+
+	return nil
+}
+
+// subsystemLogger returns the default logger tagged with a subsystem name.
+func subsystemLogger(name string) *slog.Logger {
+	return slog.Default().With("subsystem", name)
+}
+
+// journaldHandler writes text records without a timestamp, which the
+// journal adds itself, prefixed with the sd-daemon priority of the level
+// so journald files them correctly.
+type journaldHandler struct {
+	inner slog.Handler
+	out   *prefixWriter
+	lock  *sync.Mutex
+}
+
+// prefixWriter puts a prefix in front of each record the text handler
+// writes. Text handlers write a record with a single call.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+}
+
+func (this *prefixWriter) Write(p []byte) (n int, err error) {
+
+	if _, err = io.WriteString(this.w, this.prefix); err != nil {
+		return 0, err
+	}
+
+	return this.w.Write(p)
+}
+
+func newJournaldHandler(w io.Writer, level slog.Level) *journaldHandler {
+
+	out := &prefixWriter{w: w}
+
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			return a
+		}}
+
+	return &journaldHandler{
+		inner: slog.NewTextHandler(out, opts),
+		out:   out,
+		lock:  &sync.Mutex{}}
+}
+
+func journaldPriority(level slog.Level) string {
+
+	switch {
+	case level >= slog.LevelError:
+		return "<3>"
+	case level >= slog.LevelWarn:
+		return "<4>"
+	case level >= slog.LevelInfo:
+		return "<6>"
+	default:
+		return "<7>"
+	}
+}
+
+func (this *journaldHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return this.inner.Enabled(ctx, level)
+}
+
+func (this *journaldHandler) Handle(ctx context.Context, r slog.Record) error {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.out.prefix = journaldPriority(r.Level)
+
+	return this.inner.Handle(ctx, r)
+}
+
+func (this *journaldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+
+	return &journaldHandler{
+		inner: this.inner.WithAttrs(attrs),
+		out:   this.out,
+		lock:  this.lock}
+}
+
+func (this *journaldHandler) WithGroup(name string) slog.Handler {
+
+	return &journaldHandler{
+		inner: this.inner.WithGroup(name),
+		out:   this.out,
+		lock:  this.lock}
+}
@@ -1,17 +1,114 @@
 package main
 
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
 func main() {
 
-	r, _ := NewSerialRemote("/dev/ttyUSB0", 19200)
+	if filepath.Base(os.Args[0]) == "amipiborg-dump" {
+		os.Exit(DumpMain(os.Args[1:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dump" {
+		os.Exit(DumpMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(AdminMain(os.Args[2:]))
+	}
+
+	cfg, err := ParseConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(2)
+	}
+
+	if err = SetupLogging(cfg.Log); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(2)
+	}
+
+	r, err := cfg.CreateRemote()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
 
 	hf := NewHandlerFactory()
 
-	hf.AddHandler(HT_Ping, "PING", NewPingHandler)
-	hf.AddHandler(HT_Date, "DATE", NewDateHandler)
-	hf.AddHandler(HT_Input, "INPUT", NewInputHandler)
-	hf.AddHandler(HT_FS, "FS", NewFsHandler)
+	handlers := []struct {
+		info    HandlerInfo
+		builder func() ContextHandler
+	}{
+		{HandlerInfo{HT_Ping, HN_Ping, 1, 0, "Echoes data back"}, NewPingHandler},
+		{HandlerInfo{HT_Date, HN_Date, 1, HF_Notifies, "Sets the Amiga clock from the Pi"}, NewDateHandler},
+		{HandlerInfo{HT_Input, HN_Input, 1, HF_Exclusive | HF_Notifies | HF_Interactive, "Pi keyboard and mouse"}, LegacyHandler(NewInputHandler)},
+		{HandlerInfo{HT_FS, HN_FS, 1, HF_Notifies, "Pi file system and removable media"}, LegacyHandler(func() Handler { return NewFsHandler(cfg.Fs) })}}
+
+	for _, h := range handlers {
+		if cfg.HandlerEnabled(h.info.Name) {
+			hf.RegisterContextHandler(h.info, h.builder)
+		}
+	}
 
 	srv := NewServer(r, hf)
+	srv.SetRetransmitDepth(cfg.RetransmitDepth)
+	srv.SetKeepalive(time.Duration(cfg.KeepaliveInterval)*time.Second, cfg.KeepaliveMisses)
+
+	if cfg.Admin != "" {
+		if err = StartAdminServer(cfg.Admin, srv); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if cfg.Metrics != "" {
+		srv.RegisterMetrics(DefaultRegistry)
+		if err = StartMetricsServer(cfg.Metrics); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if cfg.Capture != "" {
+		c, err := CreateCapture(cfg.Capture)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		defer c.Close()
+		srv.SetCapture(c)
+	}
+
+	// A replay is over once the capture has been played back.
+	rr, replaying := r.(*ReplayRemote)
+	if replaying {
+		go func() {
+			<-rr.Done()
+			srv.Stop()
+		}()
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		srv.Stop()
+	}()
+
+	if err = srv.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
 
-	srv.Run()
+	if replaying && rr.Report(os.Stdout) > 0 {
+		os.Exit(1)
+	}
 }
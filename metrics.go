@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	MK_Counter   = "counter"
+	MK_Gauge     = "gauge"
+	MK_Histogram = "histogram"
+)
+
+// Registry holds metrics and writes them in the Prometheus text format.
+// Asking for a metric that is already registered returns the existing one,
+// so every server or handler instance can register what it uses.
+type Registry struct {
+	lock     sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	lock    sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+}
+
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*metricFamily)}
+}
+
+func (this *Registry) family(name string, help string, kind string, labels []string) *metricFamily {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if f, ok := this.families[name]; ok {
+		return f
+	}
+
+	f := &metricFamily{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*metricSeries)}
+
+	this.families[name] = f
+
+	return f
+}
+
+func (this *metricFamily) get(labelValues []string) *metricSeries {
+
+	key := strings.Join(labelValues, "\x00")
+
+	s, ok := this.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues}
+		if this.kind == MK_Histogram {
+			s.counts = make([]uint64, len(this.buckets))
+		}
+		this.series[key] = s
+	}
+
+	return s
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	family *metricFamily
+	series *metricSeries
+}
+
+type CounterVec struct {
+	family *metricFamily
+}
+
+func (this *Registry) Counter(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{this.family(name, help, MK_Counter, labels)}
+}
+
+// With returns the series for labelValues. Keep it rather than asking
+// again for every update.
+func (this *CounterVec) With(labelValues ...string) *Counter {
+
+	this.family.lock.Lock()
+	defer this.family.lock.Unlock()
+
+	return &Counter{this.family, this.family.get(labelValues)}
+}
+
+// Delete drops the series for labelValues, for things that are gone for
+// good. Counters got from With before keep counting but aren't written.
+func (this *CounterVec) Delete(labelValues ...string) {
+
+	this.family.lock.Lock()
+	delete(this.family.series, strings.Join(labelValues, "\x00"))
+	this.family.lock.Unlock()
+}
+
+func (this *Counter) Add(v float64) {
+
+	this.family.lock.Lock()
+	this.series.value += v
+	this.family.lock.Unlock()
+}
+
+func (this *Counter) Inc() {
+	this.Add(1)
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	family *metricFamily
+	series *metricSeries
+}
+
+type GaugeVec struct {
+	family *metricFamily
+}
+
+func (this *Registry) Gauge(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{this.family(name, help, MK_Gauge, labels)}
+}
+
+func (this *GaugeVec) With(labelValues ...string) *Gauge {
+
+	this.family.lock.Lock()
+	defer this.family.lock.Unlock()
+
+	return &Gauge{this.family, this.family.get(labelValues)}
+}
+
+func (this *Gauge) Set(v float64) {
+
+	this.family.lock.Lock()
+	this.series.value = v
+	this.family.lock.Unlock()
+}
+
+// GaugeFunc registers a gauge whose values are collected when the metrics
+// are read. The last one registered under a name wins.
+func (this *Registry) GaugeFunc(name string, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+
+	f := this.family(name, help, MK_Gauge, labels)
+
+	f.lock.Lock()
+	f.collect = collect
+	f.lock.Unlock()
+}
+
+// Histogram counts observations into buckets with the given upper bounds.
+type Histogram struct {
+	family *metricFamily
+	series *metricSeries
+}
+
+type HistogramVec struct {
+	family *metricFamily
+}
+
+func (this *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+
+	f := this.family(name, help, MK_Histogram, labels)
+
+	f.lock.Lock()
+	if f.buckets == nil {
+		f.buckets = buckets
+	}
+	f.lock.Unlock()
+
+	return &HistogramVec{f}
+}
+
+func (this *HistogramVec) With(labelValues ...string) *Histogram {
+
+	this.family.lock.Lock()
+	defer this.family.lock.Unlock()
+
+	return &Histogram{this.family, this.family.get(labelValues)}
+}
+
+func (this *Histogram) Observe(v float64) {
+
+	this.family.lock.Lock()
+	defer this.family.lock.Unlock()
+
+	s := this.series
+	for ix, b := range this.family.buckets {
+		if v <= b {
+			s.counts[ix]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+
+	pairs := []string{}
+	for ix, name := range names {
+		if ix < len(values) {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[ix]))
+		}
+	}
+	for ix := 0; ix+1 < len(extra); ix += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[ix], extra[ix+1]))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (this *metricFamily) write(w io.Writer) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", this.name, this.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", this.name, this.kind)
+
+	if this.collect != nil {
+		this.collect(func(value float64, labelValues ...string) {
+			fmt.Fprintf(w, "%s%s %s\n", this.name, formatLabels(this.labels, labelValues), formatValue(value))
+		})
+		return
+	}
+
+	keys := make([]string, 0, len(this.series))
+	for key := range this.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := this.series[key]
+
+		if this.kind != MK_Histogram {
+			fmt.Fprintf(w, "%s%s %s\n", this.name, formatLabels(this.labels, s.labelValues), formatValue(s.value))
+			continue
+		}
+
+		for ix, b := range this.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", this.name, formatLabels(this.labels, s.labelValues, "le", formatValue(b)), s.counts[ix])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", this.name, formatLabels(this.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", this.name, formatLabels(this.labels, s.labelValues), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", this.name, formatLabels(this.labels, s.labelValues), s.count)
+	}
+}
+
+// Write writes every metric, sorted by name.
+func (this *Registry) Write(w io.Writer) {
+
+	this.lock.Lock()
+	names := make([]string, 0, len(this.families))
+	for name := range this.families {
+		names = append(names, name)
+	}
+	this.lock.Unlock()
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		this.lock.Lock()
+		f := this.families[name]
+		this.lock.Unlock()
+
+		f.write(w)
+	}
+}
+
+func (this *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	this.Write(w)
+}
+
+// StartMetricsServer serves the default registry on /metrics at addr.
+func StartMetricsServer(addr string) (err error) {
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", DefaultRegistry)
+
+	log := subsystemLogger("metrics")
+	log.Info("Serving metrics", "addr", l.Addr().String())
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Error("Metrics server stopped", "err", err)
+		}
+	}()
+
+	return nil
+}
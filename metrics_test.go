@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+
+	r := NewRegistry()
+
+	c := r.Counter("test_requests_total", "Requests by result.", "result")
+	c.With("ok").Add(3)
+	c.With("failed").Inc()
+	c.With("ok").Inc()
+
+	r.Gauge("test_temperature", "Degrees.").With().Set(21.5)
+
+	r.GaugeFunc("test_queue", "Queued items.", []string{"queue"}, func(emit func(value float64, labelValues ...string)) {
+		emit(2, "in")
+		emit(0, "out")
+	})
+
+	h := r.Histogram("test_seconds", "How long it took.", []float64{0.1, 1}, "op")
+	h.With("read").Observe(0.05)
+	h.With("read").Observe(0.5)
+	h.With("read").Observe(5)
+
+	out := new(bytes.Buffer)
+	r.Write(out)
+
+	want := `# HELP test_queue Queued items.
+# TYPE test_queue gauge
+test_queue{queue="in"} 2
+test_queue{queue="out"} 0
+# HELP test_requests_total Requests by result.
+# TYPE test_requests_total counter
+test_requests_total{result="failed"} 1
+test_requests_total{result="ok"} 4
+# HELP test_seconds How long it took.
+# TYPE test_seconds histogram
+test_seconds_bucket{op="read",le="0.1"} 1
+test_seconds_bucket{op="read",le="1"} 2
+test_seconds_bucket{op="read",le="+Inf"} 3
+test_seconds_sum{op="read"} 5.55
+test_seconds_count{op="read"} 3
+# HELP test_temperature Degrees.
+# TYPE test_temperature gauge
+test_temperature 21.5
+`
+
+	if out.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestPacketCounts(t *testing.T) {
+
+	r := NewRegistry()
+	m := newServerMetrics(r)
+
+	m.packet(MT_Data, "in")
+	m.packet(MT_Data, "in")
+	m.packet(MT_Ack, "out")
+
+	// Counting is on every packet, it mustn't cost an allocation.
+	if allocs := testing.AllocsPerRun(100, func() { m.packet(MT_Data, "out") }); allocs != 0 {
+		t.Fatalf("%v allocations per packet", allocs)
+	}
+
+	out := new(bytes.Buffer)
+	r.Write(out)
+
+	for _, want := range []string{
+		`amipiborg_packets_total{type="MT_Data",direction="in"} 2`,
+		`amipiborg_packets_total{type="MT_Ack",direction="out"} 1`,
+		`amipiborg_packets_total{type="MT_Data",direction="out"} 101`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
+
+func TestConnectionPacketCounts(t *testing.T) {
+
+	r := NewRegistry()
+	_, amiga := startServer(t, func(srv *Server, hf *HandlerFactory) {
+		srv.metrics = newServerMetrics(r)
+		srv.RegisterMetrics(r)
+	})
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(3, HT_Ping); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Send(3, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := amiga.Expect(3, MT_Data); err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(bytes.Buffer)
+	r.Write(out)
+
+	for _, want := range []string{
+		`amipiborg_connection_packets_total{conn="3",direction="in"} 1`,
+		`amipiborg_connection_packets_total{conn="3",direction="out"} 2`,
+		`amipiborg_connections 1`,
+		`amipiborg_connection_queue_depth{conn="3",queue="in"} 0`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %s in\n%s", want, out.String())
+		}
+	}
+
+	// The counts go with the connection.
+	if err := amiga.Disconnect(3); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	r.Write(out)
+
+	if strings.Contains(out.String(), `conn="3"`) {
+		t.Fatalf("connection 3 still counted in\n%s", out.String())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// The rate never drops below this fraction of the line speed.
+	PacingMinRate = 1.0 / 16
+
+	// While no packets are lost the rate climbs by this fraction of the
+	// line speed every PacingInterval. Losses within PacingInterval of a
+	// slow down are taken as part of the same burst.
+	PacingStep     = 0.1
+	PacingInterval = time.Second
+)
+
+// writePacer spaces out writes so no more than rate bytes a second go to
+// the line. The rate starts at the line speed, halves whenever the Amiga
+// loses a packet and climbs back while it doesn't.
+type writePacer struct {
+	lock       sync.Mutex
+	lineRate   float64
+	rate       float64
+	free       time.Time
+	lastChange time.Time
+	gauge      *Gauge
+	log        *slog.Logger
+}
+
+// newWritePacer paces a line that carries lineRate bytes a second.
+func newWritePacer(lineRate float64, gauge *Gauge, log *slog.Logger) *writePacer {
+
+	wp := &writePacer{
+		lineRate: lineRate,
+		rate:     lineRate,
+		gauge:    gauge,
+		log:      log}
+
+	wp.gauge.Set(wp.rate)
+
+	return wp
+}
+
+// wait blocks until size more bytes may be written.
+func (this *writePacer) wait(size int) {
+
+	this.lock.Lock()
+
+	now := time.Now()
+	this.speedUp(now)
+
+	if this.free.Before(now) {
+		this.free = now
+	}
+	start := this.free
+	this.free = this.free.Add(time.Duration(float64(size) / this.rate * float64(time.Second)))
+
+	this.lock.Unlock()
+
+	time.Sleep(time.Until(start))
+}
+
+func (this *writePacer) speedUp(now time.Time) {
+
+	if this.rate >= this.lineRate || now.Sub(this.lastChange) < PacingInterval {
+		return
+	}
+
+	this.rate += this.lineRate * PacingStep
+	if this.rate >= this.lineRate {
+		this.rate = this.lineRate
+		this.log.Info("Writing at line speed", "rate", int(this.rate))
+	} else {
+		this.log.Debug("Speeding up writes", "rate", int(this.rate))
+	}
+	this.lastChange = now
+	this.gauge.Set(this.rate)
+}
+
+// backoff halves the rate after the Amiga lost a packet.
+func (this *writePacer) backoff() {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(this.lastChange) < PacingInterval {
+		return
+	}
+
+	this.rate /= 2
+	if this.rate < this.lineRate*PacingMinRate {
+		this.rate = this.lineRate * PacingMinRate
+	}
+	this.lastChange = now
+	this.gauge.Set(this.rate)
+
+	this.log.Info("Slowing down writes", "rate", int(this.rate))
+}
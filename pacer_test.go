@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestPacer() *writePacer {
+	return newWritePacer(10000, NewRegistry().Gauge("rate", "Rate.").With(), subsystemLogger("test"))
+}
+
+func TestPacerBackoff(t *testing.T) {
+
+	tests := []struct {
+		resends int
+		rate    float64
+	}{
+		{0, 10000},
+		{1, 5000},
+		{2, 2500},
+		{3, 1250},
+		{4, 625},
+		// The floor, a sixteenth of the line speed.
+		{5, 625},
+		{20, 625}}
+
+	for _, test := range tests {
+		p := newTestPacer()
+		for ix := 0; ix < test.resends; ix++ {
+			p.lastChange = time.Now().Add(-PacingInterval)
+			p.backoff()
+		}
+		if p.rate != test.rate {
+			t.Errorf("after %d resends: rate %v, want %v", test.resends, p.rate, test.rate)
+		}
+	}
+
+	// Losses from one burst only count once.
+	p := newTestPacer()
+	p.backoff()
+	p.backoff()
+	if p.rate != 5000 {
+		t.Fatalf("burst: rate %v, want 5000", p.rate)
+	}
+}
+
+func TestPacerSpeedUp(t *testing.T) {
+
+	tests := []struct {
+		intervals int
+		rate      float64
+	}{
+		{0, 625},
+		{1, 1625},
+		{2, 2625},
+		{5, 5625},
+		{9, 9625},
+		// Never faster than the line.
+		{10, 10000},
+		{15, 10000}}
+
+	for _, test := range tests {
+		p := newTestPacer()
+		for ix := 0; ix < 4; ix++ {
+			p.lastChange = time.Now().Add(-PacingInterval)
+			p.backoff()
+		}
+
+		now := p.lastChange
+		for ix := 0; ix < test.intervals; ix++ {
+			// Not yet, a step takes a whole interval.
+			p.speedUp(now.Add(PacingInterval / 2))
+			now = now.Add(PacingInterval)
+			p.speedUp(now)
+		}
+		if p.rate != test.rate {
+			t.Errorf("after %d clean intervals: rate %v, want %v", test.intervals, p.rate, test.rate)
+		}
+	}
+}
+
+func TestPacerWait(t *testing.T) {
+
+	// 300 bytes at 10000 a second, the last 100 may start after 20ms.
+	p := newTestPacer()
+	start := time.Now()
+	for ix := 0; ix < 3; ix++ {
+		p.wait(100)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Fatalf("300 bytes let through in %v", d)
+	}
+}
+
+func TestSerialPacing(t *testing.T) {
+
+	config := DefaultConfig().Remote
+	config.Baud = 115200
+
+	sr, _ := NewSerialRemote(config)
+	if sr.pacer == nil || sr.pacer.rate != float64(time.Second)/float64(sr.byteTime()) {
+		t.Fatal("no pacing at line speed without flow control")
+	}
+
+	// The Amiga paces the writes itself.
+	config.Flow = FC_RTSCTS
+	sr, _ = NewSerialRemote(config)
+	if sr.pacer != nil {
+		t.Fatal("paced with RTS/CTS")
+	}
+	sr.Backoff()
+}
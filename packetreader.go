@@ -3,6 +3,9 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"sync/atomic"
 )
 
 type InPacket struct {
@@ -15,21 +18,43 @@ type InPacket struct {
 }
 
 type PacketReader struct {
-	remote     Remote
-	control    chan bool
-	bufferPool *BufferPool
-	outChan    chan *InPacket
-	buf        []byte
+	remote       Remote
+	control      chan bool
+	bufferPool   *BufferPool
+	outChan      chan *InPacket
+	errChan      chan *ProtocolError
+	buf          []byte
+	packets      uint64
+	droppedBytes uint64
+	badChecksums uint64
+	requireCRC   int32
+	capture      *Capture
+	metrics      readerMetrics
+	log          *slog.Logger
+}
+
+type readerMetrics struct {
+	bytes        *Counter
+	packets      *Counter
+	droppedBytes *Counter
+	badChecksums *Counter
 }
 
 func NewPacketReader(bufferPool *BufferPool, remote Remote) *PacketReader {
 
 	pr := &PacketReader{
-		remote,
-		make(chan bool),
-		bufferPool,
-		make(chan *InPacket, 100),
-		make([]byte, 0, 100)}
+		remote:     remote,
+		control:    make(chan bool),
+		bufferPool: bufferPool,
+		outChan:    make(chan *InPacket, 100),
+		errChan:    make(chan *ProtocolError, 10),
+		buf:        make([]byte, 0, 100),
+		metrics: readerMetrics{
+			bytes:        DefaultRegistry.Counter("amipiborg_received_bytes_total", "Bytes read from the Amiga.").With(),
+			packets:      DefaultRegistry.Counter("amipiborg_received_packets_total", "Good packets read from the Amiga.").With(),
+			droppedBytes: DefaultRegistry.Counter("amipiborg_dropped_bytes_total", "Bytes thrown away looking for the start of a packet.").With(),
+			badChecksums: DefaultRegistry.Counter("amipiborg_bad_checksums_total", "Packets with a bad checksum or CRC, or missing a CRC.").With()},
+		log: subsystemLogger("framer")}
 
 	return pr
 }
@@ -38,6 +63,30 @@ func (this *PacketReader) GetOutputChannel() (outChan chan *InPacket) {
 	return this.outChan
 }
 
+// GetErrorChannel delivers packets that had to be thrown away, for the
+// server to tell the Amiga about.
+func (this *PacketReader) GetErrorChannel() (errChan chan *ProtocolError) {
+	return this.errChan
+}
+
+// reject reports a packet that was thrown away. Nobody may be listening,
+// so reports that don't fit are dropped.
+func (this *PacketReader) reject(pacBuf []byte, message string) {
+
+	packId := pacBuf[8:10]
+
+	e := &ProtocolError{
+		Code:    EC_BadPacket,
+		ConnId:  binary.BigEndian.Uint16(pacBuf[6:]),
+		Message: fmt.Sprintf("%s on packet %d", message, binary.BigEndian.Uint16(packId)),
+		Data:    append([]byte{}, packId...)}
+
+	select {
+	case this.errChan <- e:
+	default:
+	}
+}
+
 func (this *PacketReader) Start() {
 	go this.run()
 }
@@ -63,95 +112,177 @@ func (this *PacketReader) run() {
 func (this *PacketReader) processBuffer(buf []byte) {
 
 	this.buf = append(this.buf, buf...)
+	this.metrics.bytes.Add(float64(len(buf)))
 
 	this.bufferPool.ReleaseBuffer(buf)
 
-	maxIx := len(this.buf) - 14
-
-	ij := 0
-	packetCount := 0
-	var pacBuf []byte
-	for ij <= maxIx {
-		ix := ij
-		found := false
-		//for ix <= maxIx {
-
-		id := binary.BigEndian.Uint32(this.buf[ix:])
-		if id == PACKET_ID {
-			pacBuf = this.buf[ix:]
-			ix += 4
-			found = true
-			//		break
+	ix := 0
+	for {
+		start := this.findPacketId(ix)
+		if start < 0 {
+			// Keep a tail that could be the start of a split PACKET_ID.
+			keep := len(this.buf) - ix
+			if keep > 3 {
+				keep = 3
+			}
+			this.drop(len(this.buf) - ix - keep)
+			ix = len(this.buf) - keep
+			break
 		}
 
-		//	ix++
-		//}
+		this.drop(start - ix)
+		ix = start
 
-		if !found {
-			// No packet found at all.
-			fmt.Printf("Bad data? %d bytes\n", len(this.buf))
+		if len(this.buf)-ix < HEADER_LENGTH {
+			// Not enough bytes for a header.
+			break
+		}
 
-			for _, c := range this.buf {
-				fmt.Printf("%2x ", c)
-			}
-			fmt.Println()
+		length := binary.BigEndian.Uint16(this.buf[ix+12:])
+		if length > MAX_PACKET_LENGTH {
+			this.log.Warn("Bad packet length", "length", length)
+			this.drop(1)
+			ix++
+			continue
+		}
+
+		pacFlags := this.buf[ix+5]
+		size := HEADER_LENGTH + int(length)
+		if (pacFlags & PF_PadByte) == PF_PadByte {
+			size++
+		}
 
-			this.buf = this.buf[:0]
-			return
+		if size%2 != 0 {
+			this.log.Warn("Missing pad byte")
+			this.drop(1)
+			ix++
+			continue
 		}
 
-		if ix > maxIx+4 {
-			// Not enough bytes for a header.
-			fmt.Printf("Incomplete packet\n")
-			this.buf = this.buf[ij:]
-			return
+		hasCRC := (pacFlags & PF_CRC32) == PF_CRC32
+		crcSize := 0
+		if hasCRC {
+			crcSize = CRC_LENGTH
 		}
 
-		pacType := this.buf[ix]
-		ix++
-		pacFlags := this.buf[ix]
-		ix++
-		connId := binary.BigEndian.Uint16(this.buf[ix:])
-		ix += 2
-		packId := binary.BigEndian.Uint16(this.buf[ix:])
-		ix += 4 // Skip checksum
-		length := binary.BigEndian.Uint16(this.buf[ix:])
-		ix += 2
-
-		if ix+int(length) > len(this.buf) {
+		if len(this.buf)-ix < size+crcSize {
 			// Not enough bytes for all the data
-			this.buf = this.buf[ij:]
-			return
+			break
 		}
 
-		checksum := calculateChecksum(pacBuf, length+14)
-		if checksum != 0xffff {
-			fmt.Printf("Bad checksum\n")
-			this.buf = this.buf[ix:]
-			return
+		pacBuf := this.buf[ix : ix+size]
+		if calculateChecksum(pacBuf, uint16(size)) != 0xffff ||
+			(hasCRC && crc32.ChecksumIEEE(pacBuf) != binary.BigEndian.Uint32(this.buf[ix+size:])) {
+			this.log.Warn("Bad checksum", "conn", binary.BigEndian.Uint16(pacBuf[6:]), "id", binary.BigEndian.Uint16(pacBuf[8:]))
+			this.reject(pacBuf, "bad checksum")
+			atomic.AddUint64(&this.badChecksums, 1)
+			this.metrics.badChecksums.Inc()
+			this.drop(1)
+			ix++
+			continue
+		}
+
+		// Once CRCs are agreed only a fresh MT_Init may arrive without one.
+		if !hasCRC && atomic.LoadInt32(&this.requireCRC) != 0 &&
+			!(pacBuf[4] == MT_Init && binary.BigEndian.Uint16(pacBuf[6:]) == DEFAULT_CONNECTION) {
+			this.log.Warn("Packet without CRC", "conn", binary.BigEndian.Uint16(pacBuf[6:]), "id", binary.BigEndian.Uint16(pacBuf[8:]))
+			this.reject(pacBuf, "missing CRC")
+			atomic.AddUint64(&this.badChecksums, 1)
+			this.metrics.badChecksums.Inc()
+			this.drop(1)
+			ix++
+			continue
+		}
+
+		// The buffer is reused, so the packet needs its own copy of the data.
+		data := make([]byte, length)
+		copy(data, pacBuf[HEADER_LENGTH:])
+
+		if pacFlags&PF_Compressed != 0 {
+			plain, err := lzssDecompress(data, MAX_PACKET_LENGTH)
+			if err != nil {
+				// The checksums were good, so the sender is broken and
+				// skipping a byte won't help.
+				this.log.Warn("Bad compressed data", "conn", binary.BigEndian.Uint16(pacBuf[6:]), "id", binary.BigEndian.Uint16(pacBuf[8:]), "err", err)
+				this.reject(pacBuf, err.Error())
+				ix += size + crcSize
+				continue
+			}
+			data = plain
+			length = uint16(len(plain))
+			pacFlags &^= PF_Compressed
 		}
 
 		packet := &InPacket{
-			PacketType: pacType,
+			PacketType: pacBuf[4],
 			Flags:      pacFlags,
-			ConnId:     connId,
-			PacketId:   packId,
+			ConnId:     binary.BigEndian.Uint16(pacBuf[6:]),
+			PacketId:   binary.BigEndian.Uint16(pacBuf[8:]),
 			Length:     length,
-			Data:       this.buf[ix : ix+int(length)]}
+			Data:       data}
 
-		packetCount++
+		if this.capture != nil {
+			this.capture.Record(CD_In, this.buf[ix:ix+size+crcSize])
+		}
+
+		this.log.Debug("Received packet", "conn", packet.ConnId, "type", packet.PacketType, "id", packet.PacketId, "length", length)
+
+		atomic.AddUint64(&this.packets, 1)
+		this.metrics.packets.Inc()
 		this.outChan <- packet
 
-		ij = ix + int(length)
-		if (pacFlags & PF_PadByte) == PF_PadByte {
-			ij++
-		}
+		ix += size + crcSize
 	}
 
-	if ij >= len(this.buf) {
+	if ix >= len(this.buf) {
 		this.buf = this.buf[:0]
 	} else {
-		fmt.Printf("Clearing %d of %d bytes from buffer.\n", ij, len(this.buf))
-		this.buf = this.buf[ij:]
+		this.buf = append(this.buf[:0], this.buf[ix:]...)
+	}
+}
+
+// findPacketId returns the offset of the next PACKET_ID at or after ix,
+// or -1 if there isn't a complete one in the buffer.
+func (this *PacketReader) findPacketId(ix int) int {
+
+	for ; ix <= len(this.buf)-4; ix++ {
+		if binary.BigEndian.Uint32(this.buf[ix:]) == PACKET_ID {
+			return ix
+		}
+	}
+
+	return -1
+}
+
+func (this *PacketReader) drop(count int) {
+
+	if count > 0 {
+		this.log.Debug("Dropped bytes", "count", count)
+		atomic.AddUint64(&this.droppedBytes, uint64(count))
+		this.metrics.droppedBytes.Add(float64(count))
+	}
+}
+
+// Stats returns the number of good packets read, bytes discarded while
+// looking for the start of a packet and packets with a bad checksum.
+func (this *PacketReader) Stats() (packets uint64, droppedBytes uint64, badChecksums uint64) {
+
+	return atomic.LoadUint64(&this.packets),
+		atomic.LoadUint64(&this.droppedBytes),
+		atomic.LoadUint64(&this.badChecksums)
+}
+
+// SetRequireCRC makes the reader reject packets without a CRC-32 trailer.
+func (this *PacketReader) SetRequireCRC(required bool) {
+
+	v := int32(0)
+	if required {
+		v = 1
 	}
+	atomic.StoreInt32(&this.requireCRC, v)
+}
+
+// SetCapture records every good packet read to c. Call before Start.
+func (this *PacketReader) SetCapture(c *Capture) {
+	this.capture = c
 }
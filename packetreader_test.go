@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+// recordRemote keeps whatever is written to it.
+type recordRemote struct {
+	written [][]byte
+}
+
+func (this *recordRemote) Init(bufferPool *BufferPool) (err error) { return nil }
+func (this *recordRemote) Open() (err error)                       { return nil }
+func (this *recordRemote) Close()                                  {}
+func (this *recordRemote) GetReadChan() (readChan chan []byte)     { return nil }
+
+func (this *recordRemote) Write(data []byte) (err error) {
+	this.written = append(this.written, append([]byte{}, data...))
+	return nil
+}
+
+func TestFramerResync(t *testing.T) {
+
+	rr := &recordRemote{}
+	pw := NewPacketWriter(rr)
+	pw.Write(MT_Data, 0, 3, 1, []byte("hello"))
+	pw.Write(MT_Data, 0, 3, 2, []byte("world!"))
+	pw.Write(MT_Data, 0, 3, 3, []byte("third"))
+
+	// Noise, a good packet, one with a bad payload, a false start on the
+	// magic and another good packet.
+	stream := []byte{1, 2, 0x41, 0x6d, 9}
+	stream = append(stream, rr.written[0]...)
+	bad := append([]byte{}, rr.written[1]...)
+	bad[HEADER_LENGTH] ^= 0xff
+	stream = append(stream, bad...)
+	stream = append(stream, 0x41, 0x6d, 0x50)
+	stream = append(stream, rr.written[2]...)
+
+	pr := NewPacketReader(NewBufferPool(10), rr)
+
+	// Arrives in odd sized pieces, the way a serial port delivers it.
+	for ix := 0; ix < len(stream); ix += 7 {
+		end := ix + 7
+		if end > len(stream) {
+			end = len(stream)
+		}
+		pr.processBuffer(append([]byte{}, stream[ix:end]...))
+	}
+
+	var got []string
+	for len(pr.outChan) > 0 {
+		got = append(got, string((<-pr.outChan).Data))
+	}
+	if len(got) != 2 || got[0] != "hello" || got[1] != "third" {
+		t.Fatalf("got %q", got)
+	}
+
+	packets, dropped, badChecksums := pr.Stats()
+	if packets != 2 || badChecksums != 1 || dropped == 0 {
+		t.Fatalf("stats %d packets, %d dropped, %d bad checksums", packets, dropped, badChecksums)
+	}
+}
@@ -3,25 +3,50 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
+	"hash/crc32"
+	"log/slog"
 )
 
 type PacketWriter struct {
-	remote Remote
+	remote   Remote
+	crc      bool
+	compress bool
+	queued   uint64
+	capture  *Capture
+	bytes    *Counter
+	saved    *Counter
+	log      *slog.Logger
 }
 
 func NewPacketWriter(remote Remote) *PacketWriter {
-	return &PacketWriter{remote: remote}
+	return &PacketWriter{
+		remote: remote,
+		bytes:  DefaultRegistry.Counter("amipiborg_sent_bytes_total", "Bytes written to the Amiga.").With(),
+		saved:  DefaultRegistry.Counter("amipiborg_compression_saved_bytes_total", "Bytes saved by compressing MT_Data.").With(),
+		log:    subsystemLogger("framer")}
 }
 
 func (this *PacketWriter) Write(packType uint8, flags uint8, connId uint16, packId uint16, data []byte) (err error) {
 
 	buf := new(bytes.Buffer)
 
+	// Only worth it if the packet gets shorter, pad byte included.
+	if this.compress && packType == MT_Data {
+		if c := lzssCompress(data); (len(c)+1)&^1 < (len(data)+1)&^1 {
+			this.saved.Add(float64(len(data) - len(c)))
+			data = c
+			flags |= PF_Compressed
+		}
+	}
+
 	if len(data)%2 != 0 {
 		flags |= PF_PadByte
 	}
 
+	if this.crc {
+		flags |= PF_CRC32
+	}
+
 	packet := []interface{}{
 		uint32(PACKET_ID),
 		packType,
@@ -34,7 +59,7 @@ func (this *PacketWriter) Write(packType uint8, flags uint8, connId uint16, pack
 	for _, v := range packet {
 		err = binary.Write(buf, binary.BigEndian, v)
 		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
+			this.log.Error("Encoding packet failed", "conn", connId, "err", err)
 			return err
 		}
 	}
@@ -53,7 +78,43 @@ func (this *PacketWriter) Write(packType uint8, flags uint8, connId uint16, pack
 	checksum := calculateChecksum(b, uint16(len(b)))
 	b[10] = byte((checksum >> 8) & 0xff)
 	b[11] = byte(checksum & 0xff)
-	this.remote.Write(b)
+
+	if this.crc {
+		b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	}
+
+	this.log.Debug("Sending packet", "conn", connId, "type", packType, "id", packId, "length", len(data))
+
+	if this.capture != nil {
+		this.capture.Record(CD_Out, b)
+	}
+
+	this.bytes.Add(float64(len(b)))
+
+	if err = this.remote.Write(b); err != nil {
+		return err
+	}
+	this.queued += uint64(len(b))
 
 	return err
 }
+
+// Queued returns how many bytes have been handed to the remote so far.
+func (this *PacketWriter) Queued() uint64 {
+	return this.queued
+}
+
+// SetCRC turns the CRC-32 trailer on outgoing packets on or off.
+func (this *PacketWriter) SetCRC(enabled bool) {
+	this.crc = enabled
+}
+
+// SetCompression turns compression of MT_Data payloads on or off.
+func (this *PacketWriter) SetCompression(enabled bool) {
+	this.compress = enabled
+}
+
+// SetCapture records every packet written to c.
+func (this *PacketWriter) SetCapture(c *Capture) {
+	this.capture = c
+}
@@ -1,32 +1,32 @@
 package main
 
 import (
-	"fmt"
+	"context"
 )
 
 type PingHandler struct {
-	outChan chan *OutPacket
 }
 
-func (this *PingHandler) Init(outChan chan *OutPacket) {
-	this.outChan = outChan
-}
-
-func (this *PingHandler) HandlePacket(p *InPacket) {
+func (this *PingHandler) Serve(ctx context.Context, conn *HandlerConn) error {
 
-	fmt.Println(p.ConnId, ": Ping")
+	for {
+		select {
+		case p := <-conn.Packets():
+			conn.Logger().Debug("Ping")
 
-	data := make([]byte, len(p.Data))
-	copy(data, p.Data)
+			data := make([]byte, len(p.Data))
+			copy(data, p.Data)
 
-	this.outChan <- &OutPacket{
-		PacketType: MT_Data,
-		Data:       data}
-}
+			if err := conn.Send(data); err != nil {
+				return err
+			}
 
-func (this *PingHandler) Quit() {
+		case <-ctx.Done():
+			return nil
+		}
+	}
 }
 
-func NewPingHandler() Handler {
+func NewPingHandler() ContextHandler {
 	return &PingHandler{}
 }
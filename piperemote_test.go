@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// PipeRemote is one end of an in-process link. Bytes written to one end
+// arrive on the read channel of the other, split into pool sized buffers
+// the same way a serial port would deliver them. Data written before the
+// other end is opened waits in its read channel.
+type PipeRemote struct {
+	bufferPool *BufferPool
+	readChan   chan []byte
+	peer       *PipeRemote
+	closed     int32
+}
+
+func NewPipeRemote() (a *PipeRemote, b *PipeRemote) {
+
+	a = &PipeRemote{
+		bufferPool: nil,
+		readChan:   make(chan []byte, 10),
+		closed:     0}
+
+	b = &PipeRemote{
+		bufferPool: nil,
+		readChan:   make(chan []byte, 10),
+		closed:     0}
+
+	a.peer = b
+	b.peer = a
+
+	return a, b
+}
+
+func (this *PipeRemote) Init(bufferPool *BufferPool) (err error) {
+	this.bufferPool = bufferPool
+
+	return nil
+}
+
+func (this *PipeRemote) Open() (err error) {
+
+	if this.bufferPool == nil {
+		this.bufferPool = NewBufferPool(100)
+	}
+
+	atomic.StoreInt32(&this.closed, 0)
+	return nil
+}
+
+func (this *PipeRemote) Close() {
+	atomic.StoreInt32(&this.closed, 1)
+}
+
+func (this *PipeRemote) GetReadChan() (readChan chan []byte) {
+	return this.readChan
+}
+
+func (this *PipeRemote) Write(data []byte) (err error) {
+
+	// Whatever goes to a closed peer is lost, like on a cable.
+	peer := this.peer
+	if atomic.LoadInt32(&this.closed) != 0 {
+		return ErrRemoteClosed
+	}
+	if atomic.LoadInt32(&peer.closed) != 0 {
+		return nil
+	}
+
+	bp := peer.bufferPool
+	if bp == nil {
+		bp = this.bufferPool
+	}
+
+	for len(data) > 0 {
+		buf := bp.AllocBuffer()
+		n := copy(buf, data)
+		data = data[n:]
+
+		peer.readChan <- buf[:n]
+	}
+
+	return nil
+}
@@ -1,9 +1,13 @@
 package main
 
 const (
-	AMIPIBORG_VERSION  = 1
-	DEFAULT_CONNECTION = 0
-	PACKET_ID          = 0x416d5069
+	AMIPIBORG_VERSION     = 2
+	AMIPIBORG_MIN_VERSION = 1
+	DEFAULT_CONNECTION    = 0
+	PACKET_ID             = 0x416d5069
+	HEADER_LENGTH         = 14
+	CRC_LENGTH            = 4
+	MAX_PACKET_LENGTH     = 4096
 )
 
 const (
@@ -16,6 +20,7 @@ const (
 	MT_Disconnect   = 0x12
 	MT_Disconnected = 0x13
 	MT_Data         = 0x20
+	MT_Ack          = 0x21
 	MT_Resend       = 0x22
 	MT_Ping         = 0x23
 	MT_Pong         = 0x24
@@ -27,6 +32,69 @@ const (
 const (
 	PF_PadByte = 0x01
 	PF_Resend  = 0x02
+	PF_CRC32   = 0x04
+
+	// MT_Data payload is LZSS compressed, see compress.go.
+	PF_Compressed = 0x08
+
+	// Part of a longer MT_Data message, see fragment.go.
+	PF_Fragment     = 0x10
+	PF_LastFragment = 0x20
+)
+
+// Capabilities, offered by the Amiga in MT_Init and confirmed in MT_Hello.
+const (
+	CAP_Window = 0x00000001
+	CAP_CRC32  = 0x00000002
+
+	// Full handler descriptors in MT_Hello, see HandlerInfo.
+	CAP_HandlerInfo = 0x00000004
+
+	// MT_Data may be sent compressed, flagged PF_Compressed.
+	CAP_Compress = 0x00000008
+
+	// MT_Data may be split into fragments, flagged PF_Fragment.
+	CAP_Fragment = 0x00000010
+
+	// Errors and refusals carry a ProtocolError.
+	CAP_ErrorInfo = 0x00000020
+
+	// The Amiga answers MT_Ping from the server, which pings it when the
+	// link is quiet and drops the session when it stops answering.
+	CAP_Keepalive = 0x00000040
+)
+
+// Error codes sent in MT_Error, see ProtocolError.
+const (
+	// Followed by uint16 oldest and newest protocol version we speak.
+	// Always sent the old way, there is no session to agree on anything.
+	EC_VersionMismatch = 0x0001
+
+	EC_HandlerFailed = 0x0002
+
+	// A packet the Amiga asked to have sent again is gone, followed by
+	// uint16 packet id.
+	EC_PacketGone = 0x0003
+
+	// Sent in MT_NoHandler and MT_NoConnection.
+	EC_NoHandler    = 0x0004
+	EC_NoConnection = 0x0005
+
+	// A packet from the Amiga was thrown away, followed by uint16 packet
+	// id. The header may be damaged too, so take the id with a pinch of
+	// salt.
+	EC_BadPacket = 0x0006
+
+	// A handler sent more than fits a packet to a client without
+	// CAP_Fragment.
+	EC_MessageTooLong = 0x0007
+
+	// A handler request failed in a way its reply can't express.
+	EC_RequestFailed = 0x0008
+
+	// Packets from the Amiga never turned up, so every connection was
+	// closed. Followed by uint16 first missing packet id and uint16 count.
+	EC_PacketsLost = 0x0009
 )
 
 func calculateChecksum(data []byte, length uint16) uint16 {
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// ProtocolError is what MT_Error carries, and MT_NoHandler and
+// MT_NoConnection too. Clients that agreed to CAP_ErrorInfo get
+//
+//	uint16 code, one of the EC_ codes
+//	uint16 connection the error is about, 0 for the link itself
+//	uint8  length of the message, then the message
+//	       whatever else the code calls for
+//
+// Older clients get the refusals empty and no MT_Error but a version
+// mismatch, which is the code followed by the extra data.
+type ProtocolError struct {
+	Code    uint16
+	ConnId  uint16
+	Message string
+	Data    []byte
+}
+
+func (this *ProtocolError) Error() string {
+	return fmt.Sprintf("%s on connection %d: %s", errorCodeName(this.Code), this.ConnId, this.Message)
+}
+
+var errorCodeNames = map[uint16]string{
+	EC_VersionMismatch: "version mismatch",
+	EC_HandlerFailed:   "handler failed",
+	EC_PacketGone:      "packet gone",
+	EC_NoHandler:       "no handler",
+	EC_NoConnection:    "no connection",
+	EC_BadPacket:       "bad packet",
+	EC_MessageTooLong:  "message too long",
+	EC_RequestFailed:   "request failed",
+	EC_PacketsLost:     "packets lost"}
+
+func errorCodeName(code uint16) string {
+
+	if name, ok := errorCodeNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("error %#04x", code)
+}
+
+// encode lays the error out for a client with or without CAP_ErrorInfo.
+func (this *ProtocolError) encode(structured bool) []byte {
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, this.Code)
+
+	if structured {
+		binary.Write(buf, binary.BigEndian, this.ConnId)
+		writeShortString(buf, this.Message)
+		buf.Write(this.Data)
+	} else if this.Data != nil {
+		buf.Write(this.Data)
+	} else {
+		buf.WriteString(this.Message)
+	}
+
+	return buf.Bytes()
+}
+
+// parseError reads an error sent with CAP_ErrorInfo.
+func parseError(data []byte) (e *ProtocolError, err error) {
+
+	if len(data) < 5 {
+		return nil, fmt.Errorf("short error, %d bytes", len(data))
+	}
+
+	e = &ProtocolError{
+		Code:   binary.BigEndian.Uint16(data),
+		ConnId: binary.BigEndian.Uint16(data[2:])}
+
+	buf := bytes.NewReader(data[4:])
+	if e.Message, err = readShortString(buf); err != nil {
+		return nil, fmt.Errorf("truncated error message")
+	}
+
+	e.Data = data[len(data)-buf.Len():]
+
+	return e, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStructuredErrors(t *testing.T) {
+
+	_, amiga := startServer(t, nil)
+	amiga.ErrorInfo = true
+	amiga.CRC = true
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	amiga.WritePacket(7, MT_Connect, []byte{0x12, 0x34})
+	p, err := amiga.Expect(7, MT_NoHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := parseError(p.Data)
+	if err != nil || e.Code != EC_NoHandler || e.ConnId != 7 || !strings.Contains(e.Message, "0x1234") {
+		t.Fatal(e, err)
+	}
+
+	amiga.WritePacket(9, MT_Data, []byte{1, 2})
+	if p, err = amiga.Expect(9, MT_NoConnection); err != nil {
+		t.Fatal(err)
+	}
+	if e, err = parseError(p.Data); err != nil || e.Code != EC_NoConnection || e.ConnId != 9 {
+		t.Fatal(e, err)
+	}
+
+	// The CRC was agreed on, a packet without one is thrown away.
+	amiga.packetWriter.SetCRC(false)
+	amiga.WritePacket(9, MT_Data, []byte{1, 2})
+	if p, err = amiga.Expect(DEFAULT_CONNECTION, MT_Error); err != nil {
+		t.Fatal(err)
+	}
+	if e, err = parseError(p.Data); err != nil || e.Code != EC_BadPacket || e.ConnId != 9 {
+		t.Fatal(e, err)
+	}
+}
+
+func TestResendGone(t *testing.T) {
+
+	srv, amiga := startServer(t, nil)
+	srv.SetRetransmitDepth(8)
+	amiga.ErrorInfo = true
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(3, HT_Ping); err != nil {
+		t.Fatal(err)
+	}
+
+	var first uint16
+	for ix := 0; ix < 20; ix++ {
+		amiga.Send(3, []byte{byte(ix), 0})
+		p, err := amiga.Expect(3, MT_Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ix == 0 {
+			first = p.PacketId
+		}
+	}
+
+	amiga.RequestResend(first)
+	p, err := amiga.Expect(3, MT_Error)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := parseError(p.Data)
+	if err != nil || e.Code != EC_PacketGone || binary.BigEndian.Uint16(e.Data) != first {
+		t.Fatal(e, err)
+	}
+}
+
+func TestLegacyErrors(t *testing.T) {
+
+	srv, amiga := startServer(t, nil)
+	srv.SetRetransmitDepth(8)
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refusals stay empty.
+	amiga.WritePacket(7, MT_Connect, []byte{0x12, 0x34})
+	p, err := amiga.Expect(7, MT_NoHandler)
+	if err != nil || len(p.Data) != 0 {
+		t.Fatal(err, p)
+	}
+
+	// An old client doesn't know MT_Error, it isn't told about the gone
+	// packet.
+	if err = amiga.Connect(3, HT_Ping); err != nil {
+		t.Fatal(err)
+	}
+	var first uint16
+	for ix := 0; ix < 20; ix++ {
+		amiga.Send(3, []byte{byte(ix), 0})
+		if p, err = amiga.Expect(3, MT_Data); err != nil {
+			t.Fatal(err)
+		}
+		if ix == 0 {
+			first = p.PacketId
+		}
+	}
+
+	amiga.RequestResend(first)
+	amiga.Timeout = 300 * time.Millisecond
+	if p, err = amiga.Receive(); err == nil {
+		t.Fatalf("got %#02x for a gone packet", p.PacketType)
+	}
+
+	// A version mismatch is the one MT_Error every client gets, laid out
+	// as before.
+	amiga.writeLock.Lock()
+	amiga.lastInPackId = 0
+	amiga.writeLock.Unlock()
+	amiga.Timeout = time.Second
+	amiga.WritePacket(DEFAULT_CONNECTION, MT_Init, make([]byte, 8))
+	if p, err = amiga.Expect(DEFAULT_CONNECTION, MT_Error); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Data) != 6 || binary.BigEndian.Uint16(p.Data) != EC_VersionMismatch {
+		t.Fatal(p.Data)
+	}
+}
+
+func TestShortPackets(t *testing.T) {
+
+	_, amiga := startServer(t, nil)
+	amiga.ErrorInfo = true
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A handler id needs two bytes.
+	id, _ := amiga.WritePacket(7, MT_Connect, []byte{0x12})
+	p, err := amiga.Expect(7, MT_NoHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := parseError(p.Data)
+	if err != nil || e.Code != EC_BadPacket || e.ConnId != 7 || binary.BigEndian.Uint16(e.Data) != id {
+		t.Fatal(e, err)
+	}
+
+	// So does a packet id.
+	id, _ = amiga.WritePacket(DEFAULT_CONNECTION, MT_Resend, []byte{})
+	if p, err = amiga.Expect(DEFAULT_CONNECTION, MT_Error); err != nil {
+		t.Fatal(err)
+	}
+	if e, err = parseError(p.Data); err != nil || e.Code != EC_BadPacket || binary.BigEndian.Uint16(e.Data) != id {
+		t.Fatal(e, err)
+	}
+
+	// The server is still there.
+	if err = amiga.Connect(3, HT_Ping); err != nil {
+		t.Fatal(err)
+	}
+}
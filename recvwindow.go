@@ -0,0 +1,133 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// How far ahead of the last packet delivered a packet may be. Anything
+	// further means we have lost track and start again from it.
+	ReceiveWindowSize = 64
+
+	// How long a missing packet is waited for. After that the server gives
+	// up on it, closes the connections and goes on with the packets after.
+	ReceiveGapTimeout = 5 * time.Second
+)
+
+// What receiveWindow.add made of a packet.
+const (
+	RS_Accepted = iota
+	RS_Duplicate
+	RS_Resync
+)
+
+// seqDiff returns how far packet id a is ahead of b, negative if it is
+// behind. Ids wrap after 65535, so this only means something for ids less
+// than half the range apart.
+func seqDiff(a uint16, b uint16) int {
+	return int(int16(a - b))
+}
+
+// receiveWindow puts the packets from the Amiga back in order and drops
+// those seen before. Packets that arrive ahead of a missing one are held
+// until it turns up or ReceiveGapTimeout passes.
+type receiveWindow struct {
+	last     uint16
+	held     map[uint16]*InPacket
+	missing  map[uint16]bool
+	gapSince time.Time
+}
+
+// newReceiveWindow expects the packet after last next.
+func newReceiveWindow(last uint16) *receiveWindow {
+
+	return &receiveWindow{
+		last:    last,
+		held:    make(map[uint16]*InPacket),
+		missing: make(map[uint16]bool)}
+}
+
+// add takes a packet and returns the packets now ready to be handled, in
+// order, along with the ids that just turned out to be missing.
+func (this *receiveWindow) add(p *InPacket, now time.Time) (status int, ready []*InPacket, missing []uint16) {
+
+	ahead := seqDiff(p.PacketId, this.last)
+	if ahead <= 0 || this.held[p.PacketId] != nil {
+		return RS_Duplicate, nil, nil
+	}
+
+	status = RS_Accepted
+	if ahead > ReceiveWindowSize {
+		status = RS_Resync
+		*this = *newReceiveWindow(p.PacketId - 1)
+		ahead = 1
+	}
+
+	delete(this.missing, p.PacketId)
+
+	if ahead > 1 {
+		for id := this.last + 1; id != p.PacketId; id++ {
+			if this.held[id] == nil && !this.missing[id] {
+				this.missing[id] = true
+				missing = append(missing, id)
+			}
+		}
+		if len(this.held) == 0 {
+			this.gapSince = now
+		}
+		this.held[p.PacketId] = p
+		return status, nil, missing
+	}
+
+	this.last = p.PacketId
+	ready = append(ready, p)
+
+	return status, this.drain(ready, now), nil
+}
+
+// drain moves held packets that are next in line to ready.
+func (this *receiveWindow) drain(ready []*InPacket, now time.Time) []*InPacket {
+
+	for {
+		next, ok := this.held[this.last+1]
+		if !ok {
+			break
+		}
+		delete(this.held, next.PacketId)
+		this.last = next.PacketId
+		ready = append(ready, next)
+	}
+
+	for id := range this.missing {
+		if seqDiff(id, this.last) <= 0 {
+			delete(this.missing, id)
+		}
+	}
+
+	// Whatever is still held now waits for the next gap.
+	this.gapSince = now
+
+	return ready
+}
+
+// expire gives up on missing packets that have been waited for too long
+// and returns the held packets after them, and how many were skipped.
+func (this *receiveWindow) expire(now time.Time) (ready []*InPacket, skipped int) {
+
+	if len(this.held) == 0 || now.Sub(this.gapSince) < ReceiveGapTimeout {
+		return nil, 0
+	}
+
+	first := -1
+	var firstId uint16
+	for id := range this.held {
+		if ahead := seqDiff(id, this.last); first < 0 || ahead < first {
+			first = ahead
+			firstId = id
+		}
+	}
+
+	this.last = firstId - 1
+
+	return this.drain(nil, now), first - 1
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func packetIds(packets []*InPacket) (ids []uint16) {
+
+	for _, p := range packets {
+		ids = append(ids, p.PacketId)
+	}
+
+	return ids
+}
+
+func TestReceiveWindowWraps(t *testing.T) {
+
+	now := time.Now()
+	w := newReceiveWindow(65533)
+	packet := func(id uint16) *InPacket { return &InPacket{PacketId: id} }
+
+	if status, ready, _ := w.add(packet(65534), now); status != RS_Accepted || len(ready) != 1 {
+		t.Fatal(status, packetIds(ready))
+	}
+
+	// 65535 and 0 are missing.
+	_, ready, missing := w.add(packet(1), now)
+	if len(ready) != 0 || len(missing) != 2 || missing[0] != 65535 || missing[1] != 0 {
+		t.Fatal(packetIds(ready), missing)
+	}
+	if status, _, _ := w.add(packet(1), now); status != RS_Duplicate {
+		t.Fatal("held packet taken twice")
+	}
+
+	w.add(packet(0), now)
+	_, ready, _ = w.add(packet(65535), now)
+	if ids := packetIds(ready); len(ids) != 3 || ids[0] != 65535 || ids[2] != 1 {
+		t.Fatal(ids)
+	}
+	if status, _, _ := w.add(packet(65535), now); status != RS_Duplicate {
+		t.Fatal("late duplicate taken")
+	}
+
+	if status, _, _ := w.add(packet(1000), now); status != RS_Resync || w.last != 1000 {
+		t.Fatal(status, w.last)
+	}
+}
+
+func TestReceiveWindowExpires(t *testing.T) {
+
+	now := time.Now()
+	w := newReceiveWindow(1000)
+	w.add(&InPacket{PacketId: 1003}, now)
+	w.add(&InPacket{PacketId: 1005}, now)
+
+	if ready, skipped := w.expire(now.Add(time.Second)); skipped != 0 || ready != nil {
+		t.Fatal("gave up too early")
+	}
+
+	ready, skipped := w.expire(now.Add(ReceiveGapTimeout))
+	if skipped != 2 || len(ready) != 1 || ready[0].PacketId != 1003 {
+		t.Fatal(skipped, packetIds(ready))
+	}
+
+	ready, skipped = w.expire(now.Add(2 * ReceiveGapTimeout))
+	if skipped != 1 || len(ready) != 1 || w.last != 1005 {
+		t.Fatal(skipped, packetIds(ready))
+	}
+}
+
+func TestDuplicateDeliveredOnce(t *testing.T) {
+
+	_, amiga := startServer(t, nil)
+	amiga.WindowSize = 8
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(3, HT_Ping); err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := amiga.WritePacket(3, MT_Data, []byte{42, 0})
+	amiga.resendPacket(id)
+
+	if _, err := amiga.Expect(3, MT_Data); err != nil {
+		t.Fatal(err)
+	}
+
+	amiga.Timeout = 300 * time.Millisecond
+	if p, err := amiga.Receive(); err == nil {
+		t.Fatalf("duplicate answered: %v", p.Data)
+	}
+}
+
+func TestGapGivenUp(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip("waits for ReceiveGapTimeout")
+	}
+
+	_, amiga := startServer(t, nil)
+	amiga.ErrorInfo = true
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(3, HT_Ping); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lost for good, the Amiga can't send it again either.
+	lost := amiga.SkipPacket(3, MT_Data, []byte{1, 0})
+	amiga.writeLock.Lock()
+	delete(amiga.sentPackets, lost)
+	amiga.writeLock.Unlock()
+
+	amiga.WritePacket(3, MT_Data, []byte{2, 0})
+
+	amiga.Timeout = ReceiveGapTimeout + 2*time.Second
+	p, err := amiga.Expect(3, MT_Error)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := parseError(p.Data)
+	if err != nil || e.Code != EC_PacketsLost || binary.BigEndian.Uint16(e.Data) != lost {
+		t.Fatal(e, err)
+	}
+
+	if _, err = amiga.Expect(3, MT_Disconnected); err != nil {
+		t.Fatal(err)
+	}
+
+	// The packet after the gap isn't handled as if nothing was missing.
+	if _, err = amiga.Expect(3, MT_NoConnection); err != nil {
+		t.Fatal(err)
+	}
+}
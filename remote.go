@@ -1,9 +1,39 @@
 package main
 
+import (
+	"errors"
+)
+
+// Write returns ErrRemoteClosed once the remote is closed.
+var ErrRemoteClosed = errors.New("remote closed")
+
 type Remote interface {
 	Init(bufferPool *BufferPool) (err error)
 	Open() (err error)
 	Close()
 	GetReadChan() (readChan chan []byte)
-	Write(data []byte)
+	Write(data []byte) (err error)
+}
+
+// LinkRemote is implemented by remotes whose link to the Amiga can go away
+// and come back, like a USB serial adapter being unplugged. They send false
+// on the link channel when the link is lost and true when it is back.
+type LinkRemote interface {
+	GetLinkChan() (linkChan chan bool)
+}
+
+// QueuedRemote is implemented by remotes that queue writes and send them
+// later. Written returns how many bytes have left the queue so far, sent or
+// thrown away, so the server can tell which packets are still waiting.
+// They send on the channel given to NotifyWritten, without blocking,
+// whenever they have written something.
+type QueuedRemote interface {
+	Written() uint64
+	NotifyWritten(wakeChan chan bool)
+}
+
+// PacedRemote is implemented by remotes that pace their writes. The server
+// calls Backoff when the Amiga lost a packet, so they can slow down.
+type PacedRemote interface {
+	Backoff()
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to wait for the server to send a recorded reply before
+	// carrying on without it.
+	ReplayTimeout = 5 * time.Second
+)
+
+// A reply that didn't match the capture. Expected is nil if the server sent
+// more packets than were recorded, Got is nil if it never sent one.
+type ReplayMismatch struct {
+	Index    int
+	Expected []byte
+	Got      []byte
+}
+
+// ReplayRemote plays the Amiga side of a capture into the server and
+// compares what the server sends back with what was recorded. Each packet
+// from the Amiga is held back until the server has sent as many packets as
+// it had at that point in the capture, so the server sees the same
+// conversation it saw when the capture was made.
+type ReplayRemote struct {
+	bufferPool *BufferPool
+	readChan   chan []byte
+	records    []CaptureRecord
+	expected   [][]byte
+	lock       sync.Mutex
+	replies    int
+	mismatches []ReplayMismatch
+	replyChan  chan bool
+	ctrlChan   chan bool
+	doneChan   chan bool
+	running    bool
+	log        *slog.Logger
+}
+
+func NewReplayRemote(path string) (rr *ReplayRemote, err error) {
+
+	cr, err := OpenCapture(path)
+	if err != nil {
+		return nil, err
+	}
+	defer cr.Close()
+
+	rr = &ReplayRemote{
+		bufferPool: nil,
+		readChan:   make(chan []byte, 10),
+		records:    make([]CaptureRecord, 0),
+		expected:   make([][]byte, 0),
+		replyChan:  make(chan bool, 1),
+		ctrlChan:   make(chan bool),
+		doneChan:   make(chan bool),
+		running:    false,
+		log:        subsystemLogger("remote").With("replay", path)}
+
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+
+		rr.records = append(rr.records, rec)
+		if rec.Direction == CD_Out {
+			rr.expected = append(rr.expected, rec.Data)
+		}
+	}
+
+	return rr, nil
+}
+
+func (this *ReplayRemote) Init(bufferPool *BufferPool) (err error) {
+	this.bufferPool = bufferPool
+
+	return nil
+}
+
+func (this *ReplayRemote) Open() (err error) {
+
+	if this.bufferPool == nil {
+		this.bufferPool = NewBufferPool(100)
+	}
+
+	this.log.Info("Replaying capture", "packets", len(this.records), "replies", len(this.expected))
+
+	this.running = true
+	go this.play()
+	return nil
+}
+
+func (this *ReplayRemote) Close() {
+
+	if !this.running {
+		return
+	}
+	this.running = false
+
+	close(this.ctrlChan)
+}
+
+func (this *ReplayRemote) GetReadChan() (readChan chan []byte) {
+	return this.readChan
+}
+
+func (this *ReplayRemote) Write(data []byte) (err error) {
+
+	got := make([]byte, len(data))
+	copy(got, data)
+
+	this.lock.Lock()
+	ix := this.replies
+	this.replies++
+	if ix >= len(this.expected) {
+		this.mismatches = append(this.mismatches, ReplayMismatch{ix, nil, got})
+	} else if !bytes.Equal(this.expected[ix], got) {
+		this.mismatches = append(this.mismatches, ReplayMismatch{ix, this.expected[ix], got})
+	}
+	this.lock.Unlock()
+
+	select {
+	case this.replyChan <- true:
+	default:
+	}
+
+	return nil
+}
+
+// Done is closed once the whole capture has been played and the server
+// has sent its last reply, or given up on.
+func (this *ReplayRemote) Done() <-chan bool {
+	return this.doneChan
+}
+
+func (this *ReplayRemote) play() {
+
+	defer close(this.doneChan)
+
+	repliesBefore := 0
+	for _, rec := range this.records {
+
+		if rec.Direction == CD_Out {
+			repliesBefore++
+			continue
+		}
+
+		if !this.waitReplies(repliesBefore) || !this.feed(rec.Data) {
+			return
+		}
+	}
+
+	this.waitReplies(len(this.expected))
+
+	this.log.Info("Replay finished")
+}
+
+// waitReplies waits until the server has sent count packets. It returns
+// false if the remote was closed meanwhile.
+func (this *ReplayRemote) waitReplies(count int) bool {
+
+	timeout := time.After(ReplayTimeout)
+
+	for {
+		this.lock.Lock()
+		got := this.replies
+		this.lock.Unlock()
+
+		if got >= count {
+			return true
+		}
+
+		select {
+		case <-this.replyChan:
+		case <-timeout:
+			this.log.Warn("Timed out waiting for reply", "reply", got)
+			return true
+		case <-this.ctrlChan:
+			return false
+		}
+	}
+}
+
+func (this *ReplayRemote) feed(data []byte) bool {
+
+	for len(data) > 0 {
+		buf := this.bufferPool.AllocBuffer()
+		n := copy(buf, data)
+		data = data[n:]
+
+		select {
+		case this.readChan <- buf[:n]:
+		case <-this.ctrlChan:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Mismatches returns every reply that differed from the capture, including
+// recorded replies the server never sent.
+func (this *ReplayRemote) Mismatches() (mismatches []ReplayMismatch) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	mismatches = append(mismatches, this.mismatches...)
+	for ix := this.replies; ix < len(this.expected); ix++ {
+		mismatches = append(mismatches, ReplayMismatch{ix, this.expected[ix], nil})
+	}
+
+	return mismatches
+}
+
+// Report writes the mismatches to w and returns how many there were.
+func (this *ReplayRemote) Report(w io.Writer) int {
+
+	mismatches := this.Mismatches()
+
+	for _, m := range mismatches {
+		switch {
+		case m.Expected == nil:
+			fmt.Fprintf(w, "reply %d: unexpected %s\n", m.Index, packetSummary(m.Got))
+		case m.Got == nil:
+			fmt.Fprintf(w, "reply %d: missing %s\n", m.Index, packetSummary(m.Expected))
+		case packetSummary(m.Expected) == packetSummary(m.Got):
+			fmt.Fprintf(w, "reply %d: %s, data differs\n", m.Index, packetSummary(m.Got))
+		default:
+			fmt.Fprintf(w, "reply %d: expected %s\n", m.Index, packetSummary(m.Expected))
+			fmt.Fprintf(w, "reply %d:      got %s\n", m.Index, packetSummary(m.Got))
+		}
+	}
+
+	fmt.Fprintf(w, "%d of %d replies differ\n", len(mismatches), len(this.expected))
+
+	return len(mismatches)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// recordSession captures a short ping session with a fake Amiga.
+func recordSession(t *testing.T, path string) {
+
+	c, err := CreateCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hf := NewHandlerFactory()
+	hf.AddContextHandler(HT_Ping, "PING", NewPingHandler)
+
+	s, a := NewPipeRemote()
+	srv := NewServer(s, hf)
+	srv.SetCapture(c)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- srv.Run()
+	}()
+
+	amiga := NewFakeAmiga(a)
+	amiga.WindowSize = 4
+	if err = amiga.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer amiga.Stop()
+
+	if _, _, err = amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err = amiga.Connect(3, HT_Ping); err != nil {
+		t.Fatal(err)
+	}
+	for ix := 0; ix < 10; ix++ {
+		if err = amiga.Send(3, []byte{byte(ix), 1, 2}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = amiga.Expect(3, MT_Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = amiga.Disconnect(3); err != nil {
+		t.Fatal(err)
+	}
+	if err = amiga.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Stop()
+	<-stopped
+	c.Close()
+}
+
+// replay plays the capture at path to a server with the handlers in hf
+// and returns how many replies differed.
+func replay(t *testing.T, path string, hf *HandlerFactory) (mismatches int, report string) {
+
+	rr, err := NewReplayRemote(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer(rr, hf)
+	go func() {
+		<-rr.Done()
+		srv.Stop()
+	}()
+	if err = srv.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(bytes.Buffer)
+	mismatches = rr.Report(out)
+
+	return mismatches, out.String()
+}
+
+func TestReplayCapture(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "session.cap")
+	recordSession(t, path)
+
+	hf := NewHandlerFactory()
+	hf.AddContextHandler(HT_Ping, "PING", NewPingHandler)
+	if mismatches, report := replay(t, path, hf); mismatches != 0 {
+		t.Fatalf("%d mismatches replaying the same server:\n%s", mismatches, report)
+	}
+
+	// A server offering another handler answers MT_Init differently.
+	hf = NewHandlerFactory()
+	hf.AddContextHandler(HT_Ping, "PONG", NewPingHandler)
+	if mismatches, _ := replay(t, path, hf); mismatches == 0 {
+		t.Fatal("replay missed a changed reply")
+	}
+}
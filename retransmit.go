@@ -0,0 +1,61 @@
+package main
+
+const (
+	DefaultRetransmitDepth = 256
+
+	// Deeper than this and the ids in the store would be ambiguous.
+	MaxRetransmitDepth = 0x8000
+)
+
+// retransmitStore keeps the last packets sent so the Amiga can ask for
+// them again. It is a ring indexed by packet id, a packet stays until the
+// id depth packets later replaces it.
+type retransmitStore struct {
+	slots []*OutPacket
+
+	// The connection of every packet pushed out of slots in the last
+	// MaxRetransmitDepth ids, so a packet that is gone can still be blamed
+	// on its connection.
+	gone map[uint16]uint16
+}
+
+func newRetransmitStore(depth int) *retransmitStore {
+
+	return &retransmitStore{
+		slots: make([]*OutPacket, depth),
+		gone:  make(map[uint16]uint16)}
+}
+
+func (this *retransmitStore) put(op *OutPacket) {
+
+	ix := int(op.PackId) % len(this.slots)
+	if old := this.slots[ix]; old != nil {
+		this.gone[old.PackId] = old.ConnId
+	}
+	this.slots[ix] = op
+
+	delete(this.gone, op.PackId)
+	delete(this.gone, op.PackId-MaxRetransmitDepth)
+}
+
+// get returns the packet sent with packId, or nil if it has been replaced.
+func (this *retransmitStore) get(packId uint16) *OutPacket {
+
+	op := this.slots[int(packId)%len(this.slots)]
+	if op == nil || op.PackId != packId {
+		return nil
+	}
+
+	return op
+}
+
+// connOf returns the connection packId was sent on, or DEFAULT_CONNECTION
+// if it was too long ago to tell.
+func (this *retransmitStore) connOf(packId uint16) uint16 {
+
+	if op := this.get(packId); op != nil {
+		return op.ConnId
+	}
+
+	return this.gone[packId]
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRetransmitStore(t *testing.T) {
+
+	rs := newRetransmitStore(4)
+	for id := uint16(1); id <= 12; id++ {
+		rs.put(&OutPacket{PackId: id, ConnId: id % 3})
+	}
+
+	for id := uint16(1); id <= 12; id++ {
+		op := rs.get(id)
+		if kept := id > 8; (op != nil) != kept {
+			t.Fatalf("packet %d kept %v, want %v", id, op != nil, kept)
+		}
+		// Gone or not, the connection is known.
+		if conn := rs.connOf(id); conn != id%3 {
+			t.Fatalf("packet %d on connection %d, want %d", id, conn, id%3)
+		}
+	}
+
+	// Too far back to tell.
+	for id := uint16(13); id != 12+MaxRetransmitDepth; id++ {
+		rs.put(&OutPacket{PackId: id, ConnId: 7})
+	}
+	if conn := rs.connOf(2); conn != DEFAULT_CONNECTION {
+		t.Fatalf("packet 2 on connection %d", conn)
+	}
+	if len(rs.gone) >= MaxRetransmitDepth {
+		t.Fatalf("%d gone packets remembered", len(rs.gone))
+	}
+}
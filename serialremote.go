@@ -1,33 +1,82 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	//"go.bug.st/serial.v1"
 	"github.com/tarm/serial"
+	"golang.org/x/sys/unix"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// How long to wait before trying to reopen a lost serial device, the
+	// delay doubles on every failed attempt up to ReconnectMaxDelay.
+	ReconnectMinDelay = 500 * time.Millisecond
+	ReconnectMaxDelay = 30 * time.Second
+
+	// How much longer than its bytes take on the line a write may take
+	// before the port is taken for lost. With RTS/CTS an Amiga that is
+	// switched off can hold us off for ever.
+	WriteStallTimeout = 5 * time.Second
+)
+
+// The port took too long to take a write, see WriteStallTimeout.
+var errWriteStalled = errors.New("write stalled")
+
+// SerialRemote talks to the Amiga over a serial port. If the device goes
+// away, a USB adapter being unplugged say, the server is told the link is
+// lost and the device is reopened once it is back.
 type SerialRemote struct {
 	bufferPool *BufferPool
 	readChan   chan []byte
 	devName    string
-	baud       int
+	config     RemoteConfig
 	port       *serial.Port
-	running    bool
+	portLock   sync.Mutex
+	running    atomic.Bool
 	writeChan  chan []byte
-	ctrlChan   chan bool
+	written    atomic.Uint64
+	wakeChan   chan bool
+	writerDone chan bool
+	quitChan   chan bool
+	lostChan   chan bool
+	linkChan   chan bool
+	pacer      *writePacer
+	stallAfter time.Duration
+	log        *slog.Logger
 }
 
-func NewSerialRemote(devName string, baud int) (sr *SerialRemote, err error) {
+var serialParities = map[string]serial.Parity{
+	SP_None: serial.ParityNone,
+	SP_Odd:  serial.ParityOdd,
+	SP_Even: serial.ParityEven}
+
+func NewSerialRemote(config RemoteConfig) (sr *SerialRemote, err error) {
 
 	sr = &SerialRemote{
 		bufferPool: nil,
 		readChan:   make(chan []byte, 10),
-		devName:    devName,
-		baud:       baud,
+		devName:    config.Device,
+		config:     config,
 		port:       nil,
-		running:    false,
 		writeChan:  make(chan []byte, 100),
-		ctrlChan:   make(chan bool)}
+		writerDone: make(chan bool),
+		quitChan:   make(chan bool),
+		lostChan:   make(chan bool, 1),
+		linkChan:   make(chan bool, 4),
+		stallAfter: WriteStallTimeout,
+		log:        subsystemLogger("remote").With("device", config.Device)}
+
+	// With RTS/CTS the Amiga holds us off itself.
+	if config.Flow != FC_RTSCTS {
+		rate := DefaultRegistry.Gauge("amipiborg_serial_write_rate_bytes", "Bytes per second the serial remote lets itself write.").With()
+		sr.pacer = newWritePacer(float64(time.Second)/float64(sr.byteTime()), rate, sr.log)
+	}
 
 	return sr, nil
 }
@@ -40,6 +89,77 @@ func (this *SerialRemote) Init(bufferPool *BufferPool) (err error) {
 
 func (this *SerialRemote) Open() (err error) {
 
+	// A device that isn't plugged in yet is waited for, anything else is
+	// most likely a configuration error.
+	err = this.openPort()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err != nil {
+		this.log.Warn("Serial device not present, waiting for it")
+	}
+
+	this.running.Store(true)
+	go this.monitor(err == nil)
+	go this.writer()
+	return nil
+}
+
+func (this *SerialRemote) Close() {
+
+	if !this.running.CompareAndSwap(true, false) {
+		return
+	}
+
+	close(this.quitChan)
+
+	// Let the writer finish before the port goes away. It doesn't wait
+	// for a write the port is stuck on.
+	<-this.writerDone
+
+	this.closePort()
+}
+
+func (this *SerialRemote) GetReadChan() (readChan chan []byte) {
+	return this.readChan
+}
+
+func (this *SerialRemote) GetLinkChan() (linkChan chan bool) {
+	return this.linkChan
+}
+
+// Backoff slows down writes, the Amiga lost a packet.
+func (this *SerialRemote) Backoff() {
+
+	if this.pacer != nil {
+		this.pacer.backoff()
+	}
+}
+
+func (this *SerialRemote) Write(data []byte) (err error) {
+
+	select {
+	case this.writeChan <- data:
+		return nil
+	case <-this.quitChan:
+		return ErrRemoteClosed
+	}
+}
+
+// Written returns how many bytes the writer has taken from its queue.
+func (this *SerialRemote) Written() uint64 {
+	return this.written.Load()
+}
+
+// NotifyWritten wakes the server whenever something was written. Call
+// before Open.
+func (this *SerialRemote) NotifyWritten(wakeChan chan bool) {
+	this.wakeChan = wakeChan
+}
+
+func (this *SerialRemote) openPort() (err error) {
+
 	/*config := &serial.Mode{
 		BaudRate: this.baud,
 		DataBits: 8,
@@ -50,69 +170,273 @@ func (this *SerialRemote) Open() (err error) {
 	*/
 	config := &serial.Config{
 		Name:     this.devName,
-		Baud:     19200,
-		Size:     serial.DefaultSize,
-		Parity:   serial.ParityNone,
-		StopBits: serial.Stop1}
+		Baud:     this.config.Baud,
+		Size:     byte(this.config.DataBits),
+		Parity:   serialParities[this.config.Parity],
+		StopBits: serial.StopBits(this.config.StopBits)}
 
-	this.port, err = serial.OpenPort(config)
+	port, err := serial.OpenPort(config)
 	if err != nil {
 		return err
 	}
 
-	this.port.Flush()
+	if this.config.Flow == FC_RTSCTS {
+		if err = setHardwareFlow(this.devName); err != nil {
+			port.Close()
+			return err
+		}
+	}
 
-	this.running = true
-	go this.reader()
-	go this.writer()
+	port.Flush()
+
+	this.portLock.Lock()
+	this.port = port
+	this.portLock.Unlock()
+
+	this.log.Info("Opened serial port", "baud", this.config.Baud, "line", this.lineName(), "flow", this.config.Flow)
+
+	go this.reader(port)
 	return nil
 }
 
-func (this *SerialRemote) Close() {
-	this.running = false
+// setHardwareFlow turns on RTS/CTS handshaking. tarm/serial has no setting
+// for it, but the line settings belong to the device, so they can be changed
+// through a second descriptor.
+func setHardwareFlow(devName string) (err error) {
+
+	fd, err := unix.Open(devName, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+
+	t.Cflag |= unix.CRTSCTS
+
+	return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+}
+
+// lineName gives the line settings the usual way, e.g. "8N1".
+func (this *SerialRemote) lineName() string {
+	return fmt.Sprintf("%d%c%d", this.config.DataBits, serialParities[this.config.Parity], this.config.StopBits)
+}
 
-	if this.port != nil {
-		this.port.Close()
+// byteTime is how long one character takes on the line, start and stop
+// bits included.
+func (this *SerialRemote) byteTime() time.Duration {
+
+	bits := 1 + this.config.DataBits + this.config.StopBits
+	if this.config.Parity != SP_None {
+		bits++
+	}
+
+	return time.Duration(bits) * time.Second / time.Duration(this.config.Baud)
+}
+
+func (this *SerialRemote) closePort() {
+
+	this.portLock.Lock()
+	port := this.port
+	this.port = nil
+	this.portLock.Unlock()
+
+	if port != nil {
+		closeSerialPort(port)
+	}
+}
+
+// closeSerialPort closes port without waiting. Close waits for reads and
+// writes in progress to return and a write held off by the Amiga may never
+// do so.
+func closeSerialPort(port *serial.Port) {
+	go port.Close()
+}
+
+func (this *SerialRemote) getPort() *serial.Port {
+
+	this.portLock.Lock()
+	defer this.portLock.Unlock()
+
+	return this.port
+}
+
+// lost closes a port that has failed and tells the monitor, unless we are
+// closing anyway. Only the first failure of a port counts, the reader and
+// the writer usually both see it.
+func (this *SerialRemote) lost(port *serial.Port, err error) {
+
+	select {
+	case <-this.quitChan:
+		return
+	default:
+	}
+
+	this.portLock.Lock()
+	current := this.port == port
+	if current {
 		this.port = nil
 	}
+	this.portLock.Unlock()
+
+	if !current {
+		return
+	}
+
+	closeSerialPort(port)
+
+	this.log.Error("Serial port failed", "err", err)
+
+	select {
+	case this.lostChan <- true:
+	default:
+	}
+}
 
+func (this *SerialRemote) setLink(up bool) {
+
+	select {
+	case this.linkChan <- up:
+	default:
+		this.log.Warn("Link state not taken", "up", up)
+	}
 }
 
-func (this *SerialRemote) GetReadChan() (readChan chan []byte) {
-	return this.readChan
+// monitor waits for the port to fail and reopens it with backoff.
+func (this *SerialRemote) monitor(open bool) {
+
+	for {
+		if open {
+			select {
+			case <-this.quitChan:
+				return
+			case <-this.lostChan:
+			}
+
+			this.setLink(false)
+		}
+
+		if !this.reopen() {
+			return
+		}
+		open = true
+		this.setLink(true)
+	}
 }
 
-func (this *SerialRemote) Write(data []byte) {
+// reopen tries to open the port until it succeeds. It returns false if the
+// remote was closed meanwhile.
+func (this *SerialRemote) reopen() bool {
+
+	delay := ReconnectMinDelay
+
+	for {
+		select {
+		case <-this.quitChan:
+			return false
+		case <-time.After(delay):
+		}
+
+		err := this.openPort()
+		if err == nil {
+			return true
+		}
+
+		this.log.Debug("Reopen failed", "err", err, "retry", delay)
 
-	this.writeChan <- data
+		delay *= 2
+		if delay > ReconnectMaxDelay {
+			delay = ReconnectMaxDelay
+		}
+	}
 }
 
+// writer writes packets no faster than the pacer allows, if there is one.
+// The port takes whatever fits in the kernel's buffer at once, without flow
+// control that would overrun the Amiga.
 func (this *SerialRemote) writer() {
 
+	defer close(this.writerDone)
+
 	for {
 		select {
-		case <-this.ctrlChan:
+		case <-this.quitChan:
 			return
 		case buf := <-this.writeChan:
-			this.port.Write(buf)
-			time.Sleep(10 * time.Millisecond)
+			// Packets written while the device is gone are lost, the
+			// session is reset once it is back.
+			port := this.getPort()
+			if port == nil {
+				this.written.Add(uint64(len(buf)))
+				continue
+			}
+
+			if this.pacer != nil {
+				this.pacer.wait(len(buf))
+			}
+
+			if !this.write(port, buf) {
+				return
+			}
+			this.written.Add(uint64(len(buf)))
+
+			select {
+			case this.wakeChan <- true:
+			default:
+			}
+		}
+	}
+}
+
+// write writes buf to port, a write that stalls counts as the port being
+// lost. A write can't be interrupted, so a stalled one is left behind to
+// finish or fail once the port is closed. It returns false if the remote
+// was closed meanwhile.
+func (this *SerialRemote) write(port *serial.Port, buf []byte) bool {
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := port.Write(buf)
+		done <- err
+	}()
+
+	stall := time.NewTimer(time.Duration(len(buf))*this.byteTime() + this.stallAfter)
+	defer stall.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			this.lost(port, err)
 		}
+	case <-stall.C:
+		this.lost(port, errWriteStalled)
+	case <-this.quitChan:
+		return false
 	}
+
+	return true
 }
 
-func (this *SerialRemote) reader() {
+func (this *SerialRemote) reader(port *serial.Port) {
 
-	for this.running {
+	for {
 
 		buf := this.bufferPool.AllocBuffer()
-		bytesRead, err := this.port.Read(buf)
+		bytesRead, err := port.Read(buf)
 		if err != nil {
-			break
+			this.lost(port, err)
+			return
 		}
 
 		if bytesRead > 0 {
-
-			this.readChan <- buf[0:bytesRead]
+			select {
+			case this.readChan <- buf[0:bytesRead]:
+			case <-this.quitChan:
+				return
+			}
 		}
 	}
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPty returns the master of a new pseudo terminal and the name of its
+// slave, which stands in for the serial device.
+func openPty(t *testing.T) (master *os.File, device string) {
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip("no pseudo terminals:", err)
+	}
+	t.Cleanup(func() { master.Close() })
+
+	fd := int(master.Fd())
+	if err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		t.Skip("can't unlock pseudo terminal:", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		t.Skip("no pseudo terminal number:", err)
+	}
+
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+// readers counts the serial readers still running.
+func readers() int {
+
+	buf := make([]byte, 1<<20)
+	return strings.Count(string(buf[:runtime.Stack(buf, true)]), "(*SerialRemote).reader")
+}
+
+func TestSerialReconnect(t *testing.T) {
+
+	master, device := openPty(t)
+
+	config := DefaultConfig().Remote
+	config.Device = device
+	sr, _ := NewSerialRemote(config)
+	sr.Init(NewBufferPool(100))
+	if err := sr.Open(); err != nil {
+		t.Skip("can't open pseudo terminal:", err)
+	}
+
+	// The Amiga keeps talking but nobody reads, so the reader is stuck
+	// handing over what it read.
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			if _, err := master.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	waitFor := func(what string, done func() bool) {
+		for start := time.Now(); !done(); time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("timed out waiting for", what)
+			}
+		}
+	}
+	waitFor("a full read queue", func() bool { return len(sr.readChan) == cap(sr.readChan) })
+
+	// The adapter goes away and comes back.
+	sr.lost(sr.getPort(), errors.New("unplugged"))
+	for _, want := range []bool{false, true} {
+		select {
+		case up := <-sr.GetLinkChan():
+			if up != want {
+				t.Fatalf("link up %v, want %v", up, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no link change")
+		}
+	}
+
+	sr.Close()
+	waitFor("the readers to stop", func() bool { return readers() == 0 })
+}
+
+func TestSerialWriteStall(t *testing.T) {
+
+	// Nobody reads the other end, so writes block once the pseudo
+	// terminal's buffer is full, as they do while the Amiga holds CTS low.
+	_, device := openPty(t)
+
+	config := DefaultConfig().Remote
+	config.Device = device
+	config.Baud = 115200
+	config.Flow = FC_RTSCTS
+	sr, _ := NewSerialRemote(config)
+	sr.stallAfter = 100 * time.Millisecond
+	sr.Init(NewBufferPool(100))
+	if err := sr.Open(); err != nil {
+		t.Skip("can't open pseudo terminal:", err)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		buf := make([]byte, MAX_PACKET_LENGTH)
+		for {
+			if err := sr.Write(buf); err != nil {
+				written <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case up := <-sr.GetLinkChan():
+		if up {
+			t.Fatal("link came up")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stalled write not taken for a lost link")
+	}
+
+	closed := make(chan bool)
+	go func() {
+		sr.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for a stalled write")
+	}
+
+	if err := <-written; err != ErrRemoteClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestByteTime(t *testing.T) {
+
+	tests := []struct {
+		baud     int
+		dataBits int
+		parity   string
+		stopBits int
+		byteTime time.Duration
+		line     string
+	}{
+		// Start bit, data bits, parity bit if any and stop bits.
+		{9600, 8, SP_None, 1, time.Second * 10 / 9600, "8N1"},
+		{19200, 7, SP_Even, 1, time.Second * 10 / 19200, "7E1"},
+		{115200, 8, SP_None, 2, time.Second * 11 / 115200, "8N2"},
+		{300, 8, SP_Odd, 2, 40 * time.Millisecond, "8O2"},
+		{2400, 5, SP_None, 1, time.Second * 7 / 2400, "5N1"}}
+
+	for _, test := range tests {
+		config := DefaultConfig().Remote
+		config.Baud = test.baud
+		config.DataBits = test.dataBits
+		config.Parity = test.parity
+		config.StopBits = test.stopBits
+
+		sr, _ := NewSerialRemote(config)
+		if sr.byteTime() != test.byteTime {
+			t.Errorf("%d %s: byte time %v, want %v", test.baud, test.line, sr.byteTime(), test.byteTime)
+		}
+		if sr.lineName() != test.line {
+			t.Errorf("line %s, want %s", sr.lineName(), test.line)
+		}
+
+		// The pacer starts at the line speed in bytes.
+		want := float64(time.Second) / float64(test.byteTime)
+		if sr.pacer.lineRate != want || sr.pacer.rate != want {
+			t.Errorf("%d %s: pacer at %v, want %v", test.baud, test.line, sr.pacer.rate, want)
+		}
+	}
+}
+
+func TestHardwareFlow(t *testing.T) {
+
+	_, device := openPty(t)
+
+	fd, err := unix.Open(device, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		t.Skip("can't open pseudo terminal:", err)
+	}
+	defer unix.Close(fd)
+
+	if err = setHardwareFlow(device); err != nil {
+		t.Fatal(err)
+	}
+
+	tio, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tio.Cflag&unix.CRTSCTS == 0 {
+		t.Fatal("CRTSCTS not set")
+	}
+
+	if err = setHardwareFlow("/dev/amipiborg-missing"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
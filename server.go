@@ -4,6 +4,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
 const (
@@ -12,8 +17,9 @@ const (
 )
 
 const (
-	MaxRecentPackets = 100
-	ServerVersion    = 1
+	ServerVersion = 1
+	ServerCaps    = CAP_Window | CAP_CRC32 | CAP_HandlerInfo | CAP_Compress | CAP_Fragment | CAP_ErrorInfo | CAP_Keepalive
+	AckInterval   = 50 * time.Millisecond
 )
 
 type Server struct {
@@ -23,18 +29,130 @@ type Server struct {
 	remote         Remote
 	state          uint16
 	packId         uint16
-	lastInPackId   uint16
-	connChan       chan *OutPacket
+	recv           *receiveWindow
+	wakeChan       chan bool
 	connections    map[uint16]*Connection
+	connLock       sync.Mutex
+	schedule       []*Connection
+	nextConn       int
+	stopChan       chan bool
+	adminChan      chan *adminRequest
 	handlerFactory *HandlerFactory
-	recentPackets  []*OutPacket
+	retransmit     *retransmitStore
+	keepalive      *keepalive
+	window         *sendWindow
+	session        session
+	unackedIn      int
+	unwritten      []unwrittenPacket
+	metrics        *serverMetrics
+	log            *slog.Logger
+}
+
+type serverMetrics struct {
+	packets        *CounterVec
+	packetCounts   map[packetCount]*Counter
+	connPackets    *CounterVec
+	connCounts     map[connCount]*Counter
+	resendRequests *CounterVec
+	retransmits    *CounterVec
+	connected      *Gauge
+	inFlight       *Gauge
+	pending        *Gauge
+	rto            *Gauge
+	linkLosses     *Counter
+	duplicates     *Counter
+	skipped        *Counter
+	keepalives     *Counter
+	deadPeers      *Counter
+}
+
+type packetCount struct {
+	packetType uint8
+	direction  string
+}
+
+// packet counts a packet going in or out. Only the server goroutine calls
+// it.
+func (this *serverMetrics) packet(packetType uint8, direction string) {
+
+	key := packetCount{packetType, direction}
+
+	c, ok := this.packetCounts[key]
+	if !ok {
+		c = this.packets.With(packetTypeName(packetType), direction)
+		this.packetCounts[key] = c
+	}
+
+	c.Inc()
+}
+
+type connCount struct {
+	connId    uint16
+	direction string
+}
+
+// connPacket counts a packet going in or out on an open connection. Only
+// the server goroutine calls it.
+func (this *serverMetrics) connPacket(connId uint16, direction string) {
+
+	key := connCount{connId, direction}
+
+	c, ok := this.connCounts[key]
+	if !ok {
+		c = this.connPackets.With(strconv.Itoa(int(connId)), direction)
+		this.connCounts[key] = c
+	}
+
+	c.Inc()
+}
+
+// closed drops the counts of a connection that is gone, the Amiga may use
+// its id again for something else.
+func (this *serverMetrics) closed(connId uint16) {
+
+	for _, direction := range []string{"in", "out"} {
+		delete(this.connCounts, connCount{connId, direction})
+		this.connPackets.Delete(strconv.Itoa(int(connId)), direction)
+	}
+}
+
+func newServerMetrics(r *Registry) *serverMetrics {
+
+	return &serverMetrics{
+		packets:        r.Counter("amipiborg_packets_total", "Packets handled by the server by type.", "type", "direction"),
+		packetCounts:   make(map[packetCount]*Counter),
+		connPackets:    r.Counter("amipiborg_connection_packets_total", "Packets on each open connection.", "conn", "direction"),
+		connCounts:     make(map[connCount]*Counter),
+		resendRequests: r.Counter("amipiborg_resend_requests_total", "MT_Resend requests sent to or received from the Amiga.", "direction"),
+		retransmits:    r.Counter("amipiborg_retransmits_total", "Packets sent again, on request or after the ack timeout.", "reason"),
+		connected:      r.Gauge("amipiborg_connected", "1 while an Amiga has completed MT_Init.").With(),
+		inFlight:       r.Gauge("amipiborg_window_in_flight", "Packets sent and not yet acknowledged.").With(),
+		pending:        r.Gauge("amipiborg_window_pending", "Packets waiting for room in the send window.").With(),
+		rto:            r.Gauge("amipiborg_rto_seconds", "Current retransmission timeout.").With(),
+		linkLosses:     r.Counter("amipiborg_link_losses_total", "Times the remote lost its link to the Amiga.").With(),
+		duplicates:     r.Counter("amipiborg_duplicate_packets_total", "Packets from the Amiga dropped as seen before.").With(),
+		skipped:        r.Counter("amipiborg_skipped_packets_total", "Packets from the Amiga given up on after ReceiveGapTimeout.").With(),
+		keepalives:     r.Counter("amipiborg_keepalives_sent_total", "MT_Ping sent to a quiet Amiga.").With(),
+		deadPeers:      r.Counter("amipiborg_dead_peer_resets_total", "Sessions dropped because the Amiga stopped answering.").With()}
 }
 
 type OutPacket struct {
 	ConnId     uint16
 	PackId     uint16
 	PacketType uint8
+	Flags      uint8
 	Data       []byte
+	Error      *ProtocolError
+	SentAt     time.Time
+	Retries    int
+}
+
+// A connection's packet still in the remote's queue, the remote has taken
+// it once it has written end bytes.
+type unwrittenPacket struct {
+	conn *Connection
+	end  uint64
+	size int
 }
 
 func NewServer(remote Remote, handlerFac *HandlerFactory) (srv *Server) {
@@ -48,16 +166,46 @@ func NewServer(remote Remote, handlerFac *HandlerFactory) (srv *Server) {
 		remote:         remote,
 		state:          SS_Disconnected,
 		packId:         1,
-		connChan:       make(chan *OutPacket, 1000),
+		wakeChan:       make(chan bool, 1),
 		connections:    nil,
+		schedule:       nil,
+		nextConn:       0,
+		stopChan:       make(chan bool),
+		adminChan:      make(chan *adminRequest),
 		handlerFactory: handlerFac,
-		recentPackets:  make([]*OutPacket, MaxRecentPackets+1)}
+		retransmit:     newRetransmitStore(DefaultRetransmitDepth),
+		keepalive:      newKeepalive(DefaultKeepaliveInterval, DefaultKeepaliveMisses),
+		window:         newSendWindow(0),
+		recv:           newReceiveWindow(0),
+		unackedIn:      0,
+		metrics:        newServerMetrics(DefaultRegistry),
+		log:            subsystemLogger("server")}
 
 	remote.Init(bp)
 
 	return srv
 }
 
+// resetSession forgets everything about the Amiga, it has to send MT_Init
+// again before connections can be opened.
+func (this *Server) resetSession() {
+
+	this.closeConnections()
+
+	this.state = SS_Disconnected
+	this.session = session{}
+	this.packId = 1
+	this.recv = newReceiveWindow(0)
+	this.retransmit = newRetransmitStore(len(this.retransmit.slots))
+	this.unackedIn = 0
+	this.unwritten = nil
+	this.window = newSendWindow(0)
+
+	this.packetWriter.SetCRC(false)
+	this.packetWriter.SetCompression(false)
+	this.packetReader.SetRequireCRC(false)
+}
+
 func (this *Server) GetConnection(connId uint16) *Connection {
 
 	return this.connections[connId]
@@ -67,64 +215,182 @@ func (this *Server) HandleControlPacket(p *InPacket) {
 
 	switch p.PacketType {
 	case MT_Init:
-		this.state = SS_Connected
-		this.packId = 1
-		this.lastInPackId = 1
+		// The Amiga may have rebooted, drop whatever it had open before.
+		// The reply goes out plain, whatever was agreed applies after it.
+		this.resetSession()
+
+		ci, err := parseInit(p.Data)
+		if err == nil {
+			this.session, err = negotiate(ci, ServerCaps)
+		}
+		if err != nil {
+			this.log.Warn("Refusing client", "err", err)
+			this.SendVersionMismatch(err)
+			return
+		}
+
+		this.window = newSendWindow(this.session.window)
+
 		this.SendHello()
+
+		crc := this.session.has(CAP_CRC32)
+		this.packetWriter.SetCRC(crc)
+		this.packetReader.SetRequireCRC(crc)
+		this.packetWriter.SetCompression(this.session.has(CAP_Compress))
+
+		this.state = SS_Connected
+		this.connLock.Lock()
 		this.connections = make(map[uint16]*Connection)
-		fmt.Printf("Server Connected\n")
+		this.connLock.Unlock()
+		this.schedule = nil
+		this.log.Info("Connected", "version", this.session.version, "caps", this.session.caps, "window", this.session.window)
 
 	case MT_Ping:
 		this.WritePacket(DEFAULT_CONNECTION, MT_Pong, []byte{})
 
+	case MT_Pong:
+		// Hearing it was all that mattered.
+
 	case MT_Shutdown:
-		this.state = SS_Disconnected
-		this.WritePacket(DEFAULT_CONNECTION, MT_Goodbye, []byte{})
-		fmt.Printf("Server Disconnected\n")
+		// MT_Goodbye goes out now, full window or not, and isn't kept for
+		// sending again. The Amiga is gone, nothing may be retransmitted
+		// to it or keep its session alive.
+		this.metrics.packet(MT_Goodbye, "out")
+		this.packetWriter.Write(MT_Goodbye, 0, DEFAULT_CONNECTION, this.packId, []byte{})
+		this.resetSession()
+		this.log.Info("Disconnected")
 
 	case MT_Resend:
+		if len(p.Data) < 2 {
+			this.log.Warn("Short MT_Resend", "length", len(p.Data))
+			this.sendError(DEFAULT_CONNECTION, MT_Error, badPacket(p, "short MT_Resend"))
+			return
+		}
+		this.metrics.resendRequests.With("received").Inc()
+		this.backoff()
 		this.resendPacket(binary.BigEndian.Uint16(p.Data))
 	}
 }
 
+// badPacket makes the error for a packet from the Amiga that makes no
+// sense.
+func badPacket(p *InPacket, message string) *ProtocolError {
+
+	packId := make([]byte, 2)
+	binary.BigEndian.PutUint16(packId, p.PacketId)
+
+	return &ProtocolError{
+		Code:    EC_BadPacket,
+		ConnId:  p.ConnId,
+		Message: fmt.Sprintf("%s on packet %d, %d bytes", message, p.PacketId, len(p.Data)),
+		Data:    packId}
+}
+
 func (this *Server) SendHello() {
 
 	buf := new(bytes.Buffer)
 
 	binary.Write(buf, binary.BigEndian, uint16(ServerVersion))
 
-	ids, names := this.handlerFactory.GetHandlerDescriptions()
+	this.session.encode(buf)
 
-	binary.Write(buf, binary.BigEndian, uint16(len(ids)))
+	infos := this.handlerFactory.GetHandlerInfo()
 
-	for ix, id := range ids {
+	binary.Write(buf, binary.BigEndian, uint16(len(infos)))
 
-		binary.Write(buf, binary.BigEndian, id)
-		name := names[ix]
-		buf.Write([]byte(name))
-		for ij := len(name); ij < 10; ij++ {
-			binary.Write(buf, binary.BigEndian, uint8(0))
+	for _, info := range infos {
+		if this.session.has(CAP_HandlerInfo) {
+			info.encode(buf)
+		} else {
+			info.encodeLegacy(buf)
 		}
 	}
 
 	this.WritePacket(DEFAULT_CONNECTION, MT_Hello, buf.Bytes())
 }
 
+// Tells the client which protocol versions we speak.
+func (this *Server) SendVersionMismatch(err error) {
+
+	buf := new(bytes.Buffer)
+
+	binary.Write(buf, binary.BigEndian, uint16(AMIPIBORG_MIN_VERSION))
+	binary.Write(buf, binary.BigEndian, uint16(AMIPIBORG_VERSION))
+
+	this.sendError(DEFAULT_CONNECTION, MT_Error, &ProtocolError{
+		Code:    EC_VersionMismatch,
+		Message: err.Error(),
+		Data:    buf.Bytes()})
+}
+
+// sendError sends e as MT_Error or as one of the refusals.
+func (this *Server) sendError(connId uint16, packetType uint8, e *ProtocolError) {
+
+	op := &OutPacket{
+		ConnId:     connId,
+		PacketType: packetType,
+		Error:      e}
+
+	if !this.understands(op) {
+		this.log.Debug("Not sending error", "conn", connId, "err", e)
+		return
+	}
+
+	this.sendPacket(op)
+}
+
+// understands tells whether the client knows what to make of op. Apart from
+// a version mismatch, MT_Error is only for clients that asked for error
+// info.
+func (this *Server) understands(op *OutPacket) bool {
+
+	return op.PacketType != MT_Error || op.Error == nil || op.Error.Code == EC_VersionMismatch || this.session.has(CAP_ErrorInfo)
+}
+
+// errorData lays out the error in op the way the client understands.
+func (this *Server) errorData(op *OutPacket) []byte {
+
+	if op.Error.ConnId == DEFAULT_CONNECTION {
+		op.Error.ConnId = op.ConnId
+	}
+
+	structured := this.session.has(CAP_ErrorInfo)
+	if op.PacketType != MT_Error && !structured {
+		return []byte{}
+	}
+
+	return op.Error.encode(structured)
+}
+
 func (this *Server) CreateConnection(p *InPacket) {
 
+	if len(p.Data) < 2 {
+		this.log.Warn("Short MT_Connect", "conn", p.ConnId, "length", len(p.Data))
+		this.sendError(p.ConnId, MT_NoHandler, badPacket(p, "short MT_Connect"))
+		return
+	}
+
 	handlerId := binary.BigEndian.Uint16(p.Data)
 
 	h := this.handlerFactory.CreateHandler(handlerId)
 	if h == nil {
-		fmt.Printf("No handler of type %d\n", handlerId)
-		this.WritePacket(p.ConnId, MT_NoHandler, []byte{})
+		this.log.Warn("No handler", "conn", p.ConnId, "handler", handlerId)
+		this.sendError(p.ConnId, MT_NoHandler, &ProtocolError{
+			Code:    EC_NoHandler,
+			Message: fmt.Sprintf("no handler %#04x", handlerId)})
 	} else {
 
-		c := NewConnection(p.ConnId, h, this.connChan)
+		info, _ := this.handlerFactory.GetHandlerInfoById(handlerId)
 
+		c := NewConnection(p.ConnId, info, h, this.wakeChan)
+		c.fragments = this.session.has(CAP_Fragment)
+
+		this.connLock.Lock()
 		this.connections[p.ConnId] = c
+		this.connLock.Unlock()
+		this.schedule = append(this.schedule, c)
 
-		fmt.Printf("Create connection %d\n", p.ConnId)
+		this.log.Info("Create connection", "conn", p.ConnId, "handler", info.Name)
 
 		this.WritePacket(p.ConnId, MT_Connected, []byte{})
 
@@ -134,22 +400,72 @@ func (this *Server) CreateConnection(p *InPacket) {
 
 func (this *Server) HandlePacket(p *InPacket) (err error) {
 
-	if (p.Flags & PF_Resend) == 0 {
+	this.metrics.packet(p.PacketType, "in")
+	if this.GetConnection(p.ConnId) != nil {
+		this.metrics.connPacket(p.ConnId, "in")
+	}
+	this.keepalive.heard(time.Now())
+
+	// Acks are not sequenced.
+	if p.ConnId == DEFAULT_CONNECTION && p.PacketType == MT_Ack {
+		if len(p.Data) >= 2 {
+			this.handleAck(binary.BigEndian.Uint16(p.Data))
+		}
+		return nil
+	}
+
+	// MT_Init starts the numbering again, whatever came before.
+	if p.ConnId == DEFAULT_CONNECTION && p.PacketType == MT_Init {
+		this.HandleControlPacket(p)
+		this.recv = newReceiveWindow(p.PacketId)
+		return nil
+	}
 
-		if p.PacketId-1 > this.lastInPackId {
+	status, ready, missing := this.recv.add(p, time.Now())
+	switch status {
+	case RS_Duplicate:
+		// The Amiga sent it again, so it probably missed our ack.
+		this.log.Debug("Duplicate packet", "conn", p.ConnId, "id", p.PacketId)
+		this.metrics.duplicates.Inc()
+		if this.window.enabled() {
+			this.sendAck()
+		}
+		return nil
+	case RS_Resync:
+		this.log.Warn("Packet id out of window, starting again from it", "conn", p.ConnId, "id", p.PacketId)
+	}
 
-			fmt.Printf("Expecting packet %d, got packet %d\n", this.lastInPackId+1, p.PacketId)
+	if len(missing) > 0 {
+		this.log.Warn("Packets missing", "conn", p.ConnId, "expected", missing[0], "id", p.PacketId)
+		for _, id := range missing {
+			this.RequestResend(id)
+		}
+	}
 
-			for ix := this.lastInPackId + 1; ix < p.PacketId; ix++ {
-				this.RequestResend(ix)
-			}
+	if this.window.enabled() {
+		this.unackedIn++
+		if this.unackedIn >= int(this.window.size+1)/2 {
+			this.sendAck()
 		}
+	}
 
-		this.lastInPackId = p.PacketId
+	for _, rp := range ready {
+		this.dispatch(rp)
 	}
 
+	return nil
+}
+
+// dispatch handles a packet from the Amiga once it is its turn.
+func (this *Server) dispatch(p *InPacket) {
+
 	if p.ConnId == DEFAULT_CONNECTION {
 		this.HandleControlPacket(p)
+	} else if this.state != SS_Connected {
+		this.log.Warn("Packet before MT_Init", "conn", p.ConnId)
+		this.sendError(p.ConnId, MT_NoConnection, &ProtocolError{
+			Code:    EC_NoConnection,
+			Message: "not connected, send MT_Init first"})
 	} else {
 
 		cnn := this.GetConnection(p.ConnId)
@@ -159,19 +475,17 @@ func (this *Server) HandlePacket(p *InPacket) (err error) {
 				this.CreateConnection(p)
 			case MT_Disconnect:
 			default:
-				this.WritePacket(p.ConnId, MT_NoConnection, []byte{})
+				this.sendError(p.ConnId, MT_NoConnection, &ProtocolError{
+					Code:    EC_NoConnection,
+					Message: fmt.Sprintf("no connection %d", p.ConnId)})
 			}
 		} else if p.PacketType == MT_Disconnect {
-			cnn.GetControlChannel() <- true
-			fmt.Printf("Disconnect connection %d\n", p.ConnId)
-			delete(this.connections, p.ConnId)
-			this.WritePacket(p.ConnId, MT_Disconnected, []byte{})
+			this.log.Info("Disconnect connection", "conn", p.ConnId)
+			this.disconnect(cnn)
 		} else {
 			cnn.HandlePacket(p)
 		}
 	}
-
-	return nil
 }
 
 func (this *Server) RequestResend(packId uint16) {
@@ -179,40 +493,227 @@ func (this *Server) RequestResend(packId uint16) {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, packId)
 
+	this.metrics.resendRequests.With("sent").Inc()
 	this.WritePacket(DEFAULT_CONNECTION, MT_Resend, buf.Bytes())
 }
 
 func (this *Server) WritePacket(connId uint16, packetType uint8, data []byte) (pId uint16, err error) {
-	pId = this.packId
-	err = this.packetWriter.Write(packetType, 0, connId, pId, data)
-	if err != nil {
-		return 0, err
+
+	return this.sendPacket(&OutPacket{
+		ConnId:     connId,
+		PacketType: packetType,
+		Data:       data})
+}
+
+// sendPacket gives op the next packet id and sends it, or queues it while
+// the window is full.
+func (this *Server) sendPacket(op *OutPacket) (pId uint16, err error) {
+
+	op.PackId = this.packId
+
+	if op.Error != nil {
+		op.Data = this.errorData(op)
 	}
+
 	this.packId++
-	return pId, nil
+	this.retransmit.put(op)
+
+	this.metrics.packet(op.PacketType, "out")
+	if this.GetConnection(op.ConnId) != nil {
+		this.metrics.connPacket(op.ConnId, "out")
+	}
+
+	if !this.window.canSend() {
+		this.window.queue(op)
+		return op.PackId, nil
+	}
+
+	return op.PackId, this.transmit(op, 0)
+}
+
+func (this *Server) transmit(op *OutPacket, flags uint8) (err error) {
+
+	queued := this.packetWriter.Queued()
+
+	err = this.packetWriter.Write(op.PacketType, op.Flags|flags, op.ConnId, op.PackId, op.Data)
+	if err != nil {
+		return err
+	}
+
+	if flags&PF_Resend == 0 {
+		this.window.sent(op, time.Now())
+		this.trackUnwritten(op, int(this.packetWriter.Queued()-queued))
+	}
+
+	return nil
 }
 
-func (this *Server) storeOutPacket(op *OutPacket) {
-	this.recentPackets = append(this.recentPackets, op)
-	if len(this.recentPackets) > MaxRecentPackets {
-		this.recentPackets = this.recentPackets[1:]
+// trackUnwritten counts a packet against its connection until a queueing
+// remote has written it.
+func (this *Server) trackUnwritten(op *OutPacket, size int) {
+
+	if _, ok := this.remote.(QueuedRemote); !ok || op.ConnId == DEFAULT_CONNECTION {
+		return
+	}
+
+	c := this.connections[op.ConnId]
+	if c == nil {
+		return
 	}
+
+	c.unwritten += size
+	this.unwritten = append(this.unwritten, unwrittenPacket{
+		conn: c,
+		end:  this.packetWriter.Queued(),
+		size: size})
 }
 
-func (this *Server) resendPacket(packId uint16) {
+// checkWritten gives connections back the credit for packets the remote
+// has written.
+func (this *Server) checkWritten() {
 
-	fmt.Printf("Request resend of packet %d\n", packId)
-	for _, p := range this.recentPackets {
-		if p != nil && p.PackId == packId {
-			fmt.Printf("Sent\n")
-			this.packetWriter.Write(p.PacketType, PF_Resend, p.ConnId, p.PackId, p.Data)
-			break
+	qr, ok := this.remote.(QueuedRemote)
+	if !ok {
+		return
+	}
+
+	written := qr.Written()
+
+	count := 0
+	for count < len(this.unwritten) && this.unwritten[count].end <= written {
+		this.unwritten[count].conn.unwritten -= this.unwritten[count].size
+		count++
+	}
+	this.unwritten = this.unwritten[count:]
+}
+
+// The ack carries the last packet id received with nothing missing before it.
+func (this *Server) sendAck() {
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, this.recv.last)
+
+	this.packetWriter.Write(MT_Ack, 0, DEFAULT_CONNECTION, 0, buf.Bytes())
+	this.unackedIn = 0
+}
+
+func (this *Server) handleAck(packId uint16) {
+
+	for _, op := range this.window.ack(packId, time.Now()) {
+		if c := this.connections[op.ConnId]; c != nil && op.ConnId != DEFAULT_CONNECTION && c.inFlight > 0 {
+			c.inFlight--
+		}
+	}
+
+	for op := this.window.nextPending(); op != nil; op = this.window.nextPending() {
+		if err := this.transmit(op, 0); err != nil {
+			this.log.Error("Sending packet failed", "conn", op.ConnId, "id", op.PackId, "err", err)
 		}
 	}
 }
 
+func (this *Server) checkTimers(now time.Time) {
+
+	if ready, skipped := this.recv.expire(now); skipped > 0 {
+		this.log.Warn("Giving up on missing packets, closing connections", "count", skipped, "next", ready[0].PacketId)
+		this.metrics.skipped.Add(float64(skipped))
+		this.packetsLost(ready[0].PacketId-uint16(skipped), skipped)
+		for _, p := range ready {
+			this.dispatch(p)
+		}
+	}
+
+	if this.state == SS_Connected && this.session.has(CAP_Keepalive) {
+		ping, dead := this.keepalive.check(now)
+		if dead {
+			this.log.Warn("Amiga not answering, resetting session", "missed", this.keepalive.missed)
+			this.metrics.deadPeers.Inc()
+			this.resetSession()
+			return
+		}
+		if ping {
+			this.log.Debug("Link quiet, pinging Amiga", "missed", this.keepalive.missed-1)
+			this.metrics.keepalives.Inc()
+			this.WritePacket(DEFAULT_CONNECTION, MT_Ping, []byte{})
+		}
+	}
+
+	if !this.window.enabled() {
+		return
+	}
+
+	if this.unackedIn > 0 {
+		this.sendAck()
+	}
+
+	if op := this.window.expired(now); op != nil {
+		this.log.Info("Packet not acknowledged, resending", "conn", op.ConnId, "id", op.PackId, "retries", op.Retries)
+		this.metrics.retransmits.With("timeout").Inc()
+		this.backoff()
+		this.packetWriter.Write(op.PacketType, op.Flags|PF_Resend, op.ConnId, op.PackId, op.Data)
+	}
+}
+
+// packetsLost closes every connection after packets from the Amiga were
+// given up on. There is no telling whose they were, and a handler must not
+// carry on as if nothing was missing.
+func (this *Server) packetsLost(first uint16, count int) {
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, first)
+	binary.Write(buf, binary.BigEndian, uint16(count))
+
+	for _, c := range this.sortedConnections() {
+		this.log.Info("Closing connection after lost packets", "conn", c.connId)
+		this.sendError(c.connId, MT_Error, &ProtocolError{
+			Code:    EC_PacketsLost,
+			Message: fmt.Sprintf("%d packets from %d lost", count, first),
+			Data:    buf.Bytes()})
+		this.disconnect(c)
+	}
+}
+
+// backoff tells a pacing remote that the Amiga lost a packet.
+func (this *Server) backoff() {
+
+	if pr, ok := this.remote.(PacedRemote); ok {
+		pr.Backoff()
+	}
+}
+
+// resendPacket sends a packet again for the Amiga. If it is no longer kept
+// the Amiga is told, on the connection it belonged to, so it can give up on
+// that connection rather than wait for it.
+func (this *Server) resendPacket(packId uint16) {
+
+	p := this.retransmit.get(packId)
+	if p == nil {
+		connId := this.retransmit.connOf(packId)
+		this.log.Warn("Packet no longer available for resend", "conn", connId, "id", packId)
+		this.metrics.retransmits.With("gone").Inc()
+
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.BigEndian, packId)
+
+		this.sendError(connId, MT_Error, &ProtocolError{
+			Code:    EC_PacketGone,
+			Message: fmt.Sprintf("packet %d is gone", packId),
+			Data:    buf.Bytes()})
+		return
+	}
+
+	this.log.Info("Resending packet", "conn", p.ConnId, "id", packId)
+	p.Retries++
+	this.metrics.retransmits.With("request").Inc()
+	this.packetWriter.Write(p.PacketType, p.Flags|PF_Resend, p.ConnId, p.PackId, p.Data)
+}
+
 func (this *Server) Run() (err error) {
 
+	if qr, ok := this.remote.(QueuedRemote); ok {
+		qr.NotifyWritten(this.wakeChan)
+	}
+
 	err = this.remote.Open()
 	if err != nil {
 		return err
@@ -221,21 +722,227 @@ func (this *Server) Run() (err error) {
 	this.packetReader.Start()
 
 	rc := this.packetReader.GetOutputChannel()
+	ec := this.packetReader.GetErrorChannel()
+
+	var linkChan chan bool
+	if lr, ok := this.remote.(LinkRemote); ok {
+		linkChan = lr.GetLinkChan()
+	}
 
-	fmt.Printf("Listening\n")
+	ticker := time.NewTicker(AckInterval)
+	defer ticker.Stop()
+
+	this.log.Info("Listening")
 
 	for {
 		select {
 		case ip := <-rc:
 			this.HandlePacket(ip)
-		case op := <-this.connChan:
-			op.PackId, err = this.WritePacket(op.ConnId, op.PacketType, op.Data)
-			if err != nil {
-				return err
+		case e := <-ec:
+			if this.state == SS_Connected {
+				this.sendError(DEFAULT_CONNECTION, MT_Error, e)
+			}
+		case <-this.wakeChan:
+		case now := <-ticker.C:
+			this.checkTimers(now)
+		case up := <-linkChan:
+			// Whoever is on the other end starts from scratch with
+			// MT_Init. That may have been read before the link came up,
+			// so only a lost link resets the session.
+			if up {
+				this.log.Info("Link up, waiting for MT_Init")
+			} else {
+				this.log.Warn("Link lost, resetting session")
+				this.metrics.linkLosses.Inc()
+				this.resetSession()
+			}
+		case req := <-this.adminChan:
+			req.reply <- this.handleAdmin(req.args)
+		case <-this.stopChan:
+			this.closeConnections()
+			this.packetReader.Stop()
+			this.remote.Close()
+			this.log.Info("Server stopped")
+			return nil
+		}
+
+		this.checkWritten()
+
+		if err = this.sendQueued(); err != nil {
+			return err
+		}
+
+		this.updateMetrics()
+	}
+}
+
+// Stop shuts down every connection and closes the remote. Run returns
+// once it is done.
+func (this *Server) Stop() {
+	this.stopChan <- true
+}
+
+// SetRetransmitDepth sets how many sent packets are kept for the Amiga to
+// ask for again. Call before Run.
+func (this *Server) SetRetransmitDepth(depth int) {
+	this.retransmit = newRetransmitStore(depth)
+}
+
+// SetKeepalive pings the Amiga after interval without hearing from it and
+// drops the session after misses pings go unanswered. An interval of 0
+// turns it off. Call before Run.
+func (this *Server) SetKeepalive(interval time.Duration, misses int) {
+	this.keepalive = newKeepalive(interval, misses)
+}
+
+// RegisterMetrics adds the connection gauges to r. The gauges read this
+// server, so register one server only.
+func (this *Server) RegisterMetrics(r *Registry) {
+	r.GaugeFunc("amipiborg_connections", "Open connections.", nil, this.collectConnections)
+	r.GaugeFunc("amipiborg_connection_queue_depth", "Packets waiting in a connection's queues.", []string{"conn", "queue"}, this.collectQueueDepths)
+}
+
+// SetCapture records every packet sent or received to c. Call before Run.
+func (this *Server) SetCapture(c *Capture) {
+	this.packetReader.SetCapture(c)
+	this.packetWriter.SetCapture(c)
+}
+
+func (this *Server) closeConnections() {
+
+	for _, c := range this.connections {
+		this.log.Info("Closing connection", "conn", c.connId)
+		c.Close()
+		this.metrics.closed(c.connId)
+	}
+
+	this.connLock.Lock()
+	this.connections = make(map[uint16]*Connection)
+	this.connLock.Unlock()
+	this.schedule = nil
+}
+
+// disconnect closes a connection and tells the Amiga it is gone.
+func (this *Server) disconnect(cnn *Connection) {
+
+	cnn.Close()
+	this.removeConnection(cnn)
+	this.WritePacket(cnn.connId, MT_Disconnected, []byte{})
+}
+
+func (this *Server) removeConnection(cnn *Connection) {
+
+	this.connLock.Lock()
+	delete(this.connections, cnn.connId)
+	this.connLock.Unlock()
+	this.metrics.closed(cnn.connId)
+
+	for ix, c := range this.schedule {
+		if c == cnn {
+			this.schedule = append(this.schedule[:ix], this.schedule[ix+1:]...)
+			break
+		}
+	}
+}
+
+func (this *Server) updateMetrics() {
+
+	connected := 0.0
+	if this.state == SS_Connected {
+		connected = 1
+	}
+
+	this.metrics.connected.Set(connected)
+	this.metrics.inFlight.Set(float64(len(this.window.inFlight)))
+	this.metrics.pending.Set(float64(len(this.window.pending)))
+	this.metrics.rto.Set(this.window.rto.Seconds())
+}
+
+func (this *Server) collectConnections(emit func(value float64, labelValues ...string)) {
+
+	this.connLock.Lock()
+	defer this.connLock.Unlock()
+
+	emit(float64(len(this.connections)))
+}
+
+// collectQueueDepths reports how much is waiting in each connection: data
+// from the Amiga not yet taken by the handler, data from the handler not
+// yet passed on, and packets passed on that the server hasn't sent.
+func (this *Server) collectQueueDepths(emit func(value float64, labelValues ...string)) {
+
+	this.connLock.Lock()
+	defer this.connLock.Unlock()
+
+	ids := make([]int, 0, len(this.connections))
+	for id := range this.connections {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		c := this.connections[uint16(id)]
+		conn := strconv.Itoa(id)
+		emit(float64(len(c.inChan)), conn, "in")
+		emit(float64(len(c.handlerChan)), conn, "handler")
+		emit(float64(len(c.outChan)), conn, "out")
+	}
+}
+
+// sendQueued moves packets from the connections to the line while the
+// window has room. Interactive connections go first, the rest take turns
+// one packet at a time so a long transfer can't hold up everything else.
+func (this *Server) sendQueued() (err error) {
+
+	for this.window.hasRoom() {
+
+		c, op := this.nextQueued()
+		if op == nil {
+			return nil
+		}
+		if !this.understands(op) {
+			this.log.Debug("Not sending error", "conn", op.ConnId, "err", op.Error)
+			continue
+		}
+
+		// The connection gave up.
+		if op.PacketType == MT_Disconnected {
+			this.disconnect(c)
+			continue
+		}
+
+		if this.window.enabled() {
+			c.inFlight++
+		}
+
+		if _, err = this.sendPacket(op); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *Server) nextQueued() (c *Connection, op *OutPacket) {
+
+	for _, c = range this.schedule {
+		if c.priority && c.hasCredit() {
+			if op = c.nextPacket(); op != nil {
+				return c, op
+			}
+		}
+	}
+
+	count := len(this.schedule)
+	for ix := 0; ix < count; ix++ {
+		c = this.schedule[(this.nextConn+ix)%count]
+		if !c.priority && c.hasCredit() {
+			if op = c.nextPacket(); op != nil {
+				this.nextConn = (this.nextConn + ix + 1) % count
+				return c, op
 			}
-			this.storeOutPacket(op)
 		}
 	}
 
-	return err
+	return nil, nil
 }
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startServer runs a server with the ping handler over a pipe and returns
+// the fake Amiga on the other end. Both are stopped when the test ends.
+func startServer(t *testing.T, configure func(srv *Server, hf *HandlerFactory)) (srv *Server, amiga *FakeAmiga) {
+
+	hf := NewHandlerFactory()
+	hf.AddContextHandler(HT_Ping, "PING", NewPingHandler)
+
+	s, a := NewPipeRemote()
+	srv = NewServer(s, hf)
+	if configure != nil {
+		configure(srv, hf)
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- srv.Run()
+	}()
+
+	amiga = NewFakeAmiga(a)
+	if err := amiga.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		srv.Stop()
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Error("server did not stop")
+		}
+		amiga.Stop()
+	})
+
+	return srv, amiga
+}
+
+func TestHandshake(t *testing.T) {
+
+	_, amiga := startServer(t, nil)
+
+	for _, version := range []uint16{1, AMIPIBORG_VERSION} {
+		amiga.Version = version
+		amiga.WindowSize = 8
+		_, handlers, err := amiga.Init()
+		if err != nil {
+			t.Fatalf("version %d: %s", version, err)
+		}
+		if handlers[HT_Ping] != "PING" {
+			t.Fatalf("version %d: handlers %v", version, handlers)
+		}
+		if err = amiga.Ping(); err != nil {
+			t.Fatalf("version %d: %s", version, err)
+		}
+	}
+
+	if amiga.session.window != 8 || !amiga.session.has(CAP_Window) {
+		t.Fatalf("window not agreed: %+v", amiga.session)
+	}
+}
+
+func TestConnectDataDisconnect(t *testing.T) {
+
+	_, amiga := startServer(t, nil)
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(5, HT_Ping); err != nil {
+		t.Fatal(err)
+	}
+
+	for ix := 0; ix < 20; ix++ {
+		msg := bytes.Repeat([]byte{byte(ix)}, 1+ix*7)
+		if err := amiga.Send(5, msg); err != nil {
+			t.Fatal(err)
+		}
+		p, err := amiga.Expect(5, MT_Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p.Data, msg) {
+			t.Fatalf("message %d came back as %v", ix, p.Data)
+		}
+	}
+
+	if err := amiga.Disconnect(5); err != nil {
+		t.Fatal(err)
+	}
+
+	amiga.WritePacket(5, MT_Data, []byte{1, 2})
+	if _, err := amiga.Expect(5, MT_NoConnection); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := amiga.Connect(6, 0x7777); err == nil {
+		t.Fatal("connected to a handler that doesn't exist")
+	}
+}
+
+func TestResendToServer(t *testing.T) {
+
+	_, amiga := startServer(t, nil)
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(5, HT_Ping); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first is lost on the line, the server has to ask for it.
+	amiga.SkipPacket(5, MT_Data, []byte{1, 0})
+	amiga.WritePacket(5, MT_Data, []byte{2, 0})
+
+	for _, want := range []byte{1, 2} {
+		p, err := amiga.Expect(5, MT_Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Data[0] != want {
+			t.Fatalf("got %d, want %d", p.Data[0], want)
+		}
+	}
+}
+
+func TestResendFromServer(t *testing.T) {
+
+	_, amiga := startServer(t, nil)
+
+	// Every third message is lost on its first trip.
+	amiga.WindowSize = 8
+	amiga.DropIncoming = func(p *InPacket) bool {
+		if p.PacketType == MT_Data && p.Flags&PF_Resend == 0 && p.Data[0]%3 == 0 {
+			return true
+		}
+		return false
+	}
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(5, HT_Ping); err != nil {
+		t.Fatal(err)
+	}
+
+	for ix := 1; ix <= 20; ix++ {
+		amiga.Send(5, []byte{byte(ix), 0})
+	}
+
+	for ix := 1; ix <= 20; ix++ {
+		p, err := amiga.Expect(5, MT_Data)
+		if err != nil {
+			t.Fatal(ix, err)
+		}
+		if p.Data[0] != byte(ix) {
+			t.Fatalf("got %d, want %d", p.Data[0], ix)
+		}
+	}
+}
+
+// slowRemote holds back writes and lets them out at a line's pace, like a
+// serial port's queue.
+type slowRemote struct {
+	*PipeRemote
+	queue    chan []byte
+	written  atomic.Uint64
+	wakeChan chan bool
+}
+
+func newSlowRemote(pr *PipeRemote) *slowRemote {
+
+	sr := &slowRemote{
+		PipeRemote: pr,
+		queue:      make(chan []byte, 100)}
+
+	go func() {
+		for buf := range sr.queue {
+			time.Sleep(time.Duration(len(buf)) * 5 * time.Microsecond)
+			sr.PipeRemote.Write(buf)
+			sr.written.Add(uint64(len(buf)))
+			select {
+			case sr.wakeChan <- true:
+			default:
+			}
+		}
+	}()
+
+	return sr
+}
+
+func (this *slowRemote) Write(data []byte) (err error) {
+	this.queue <- data
+	return nil
+}
+
+func (this *slowRemote) Written() uint64 {
+	return this.written.Load()
+}
+
+func (this *slowRemote) NotifyWritten(wakeChan chan bool) {
+	this.wakeChan = wakeChan
+}
+
+// bulkHandler answers anything with a pile of data, the way FsHandler
+// answers a big read.
+type bulkHandler struct {
+	outChan chan *OutPacket
+	count   int
+}
+
+func (this *bulkHandler) Init(outChan chan *OutPacket) {
+	this.outChan = outChan
+}
+
+func (this *bulkHandler) Quit() {}
+
+func (this *bulkHandler) HandlePacket(p *InPacket) {
+	for ix := 0; ix < this.count; ix++ {
+		this.outChan <- &OutPacket{PacketType: MT_Data, Data: make([]byte, 500)}
+	}
+}
+
+func TestSchedulerWithoutWindow(t *testing.T) {
+
+	hf := NewHandlerFactory()
+	hf.AddHandler(9, "BULK", func() Handler { return &bulkHandler{count: 200} })
+	hf.AddContextHandler(HT_Ping, "PING", NewPingHandler)
+
+	s, a := NewPipeRemote()
+	srv := NewServer(newSlowRemote(s), hf)
+	go srv.Run()
+	defer srv.Stop()
+
+	// An old client, nothing is ever acknowledged.
+	amiga := NewFakeAmiga(a)
+	amiga.Start()
+	defer amiga.Stop()
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	amiga.Connect(2, 9)
+	amiga.Connect(3, HT_Ping)
+
+	amiga.Send(2, []byte{1})
+	time.Sleep(50 * time.Millisecond)
+	amiga.Send(3, []byte{7, 7})
+
+	answered := -1
+	for ix := 0; ix < 201; ix++ {
+		p, err := amiga.Receive()
+		if err != nil {
+			t.Fatal(ix, err)
+		}
+		if p.ConnId == 3 {
+			answered = ix
+		}
+	}
+
+	// The ping only waits for what the bulk connection had already queued.
+	if answered < 0 || answered > 40 {
+		t.Fatalf("ping answered after %d bulk packets", answered)
+	}
+}
+
+func TestCloseBlockedHandler(t *testing.T) {
+
+	_, amiga := startServer(t, func(srv *Server, hf *HandlerFactory) {
+		hf.AddHandler(9, "BULK", func() Handler { return &bulkHandler{count: 1500} })
+	})
+
+	// The Amiga stops acknowledging, so the handler fills its channel and
+	// blocks.
+	var silent atomic.Bool
+	amiga.WindowSize = 4
+	amiga.DropIncoming = func(p *InPacket) bool {
+		return silent.Load()
+	}
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(2, 9); err != nil {
+		t.Fatal(err)
+	}
+
+	silent.Store(true)
+	amiga.Send(2, []byte{1})
+	time.Sleep(200 * time.Millisecond)
+
+	// Closing the connection must not wait for the handler forever, the
+	// server has to stop when the test ends.
+	amiga.WritePacket(2, MT_Disconnect, []byte{})
+	time.Sleep(100 * time.Millisecond)
+	silent.Store(false)
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// doneHandler has nothing to say and returns at once.
+type doneHandler struct{}
+
+func (doneHandler) Serve(ctx context.Context, conn *HandlerConn) error {
+	return nil
+}
+
+func TestFinishedHandler(t *testing.T) {
+
+	_, amiga := startServer(t, func(srv *Server, hf *HandlerFactory) {
+		hf.AddContextHandler(9, "DONE", func() ContextHandler { return doneHandler{} })
+	})
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(2, 9); err != nil {
+		t.Fatal(err)
+	}
+
+	// More than the connection's queue holds, the server must still be
+	// listening afterwards.
+	for ix := 0; ix < 120; ix++ {
+		amiga.WritePacket(2, MT_Data, []byte{byte(ix)})
+	}
+
+	if err := amiga.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownEndsSession(t *testing.T) {
+
+	closed := make(chan bool, 1)
+	_, amiga := startServer(t, func(srv *Server, hf *HandlerFactory) {
+		hf.AddContextHandler(9, "WAIT", func() ContextHandler { return waitHandler{closed} })
+	})
+	amiga.WindowSize = 4
+
+	// The Amiga is switched off right after saying goodbye, it never
+	// acknowledges MT_Goodbye.
+	var off atomic.Bool
+	var goodbyes, others atomic.Int32
+	amiga.DropIncoming = func(p *InPacket) bool {
+		if !off.Load() || p.PacketType == MT_Ack {
+			return off.Load()
+		}
+		if p.PacketType == MT_Goodbye && p.Flags&PF_Resend == 0 {
+			goodbyes.Add(1)
+		} else {
+			others.Add(1)
+		}
+		return true
+	}
+
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Connect(3, 9); err != nil {
+		t.Fatal(err)
+	}
+
+	off.Store(true)
+	if _, err := amiga.WritePacket(DEFAULT_CONNECTION, MT_Shutdown, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection still open")
+	}
+
+	// Several retransmit timeouts.
+	time.Sleep(4 * MinRTO)
+
+	if goodbyes.Load() != 1 || others.Load() != 0 {
+		t.Fatalf("%d MT_Goodbye and %d other packets after MT_Shutdown", goodbyes.Load(), others.Load())
+	}
+
+	// The Amiga starts again from scratch.
+	off.Store(false)
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+}
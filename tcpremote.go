@@ -0,0 +1,216 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+type TCPRemote struct {
+	bufferPool *BufferPool
+	readChan   chan []byte
+	addr       string
+	listener   net.Listener
+	conn       net.Conn
+	connLock   sync.Mutex
+	running    atomic.Bool
+	quitChan   chan bool
+	writeChan  chan []byte
+	ctrlChan   chan bool
+	linkChan   chan bool
+	log        *slog.Logger
+}
+
+func NewTCPRemote(addr string) (tr *TCPRemote, err error) {
+
+	tr = &TCPRemote{
+		bufferPool: nil,
+		readChan:   make(chan []byte, 10),
+		addr:       addr,
+		listener:   nil,
+		conn:       nil,
+		quitChan:   make(chan bool),
+		writeChan:  make(chan []byte, 100),
+		ctrlChan:   make(chan bool),
+		linkChan:   make(chan bool, 4),
+		log:        subsystemLogger("remote")}
+
+	return tr, nil
+}
+
+func (this *TCPRemote) Init(bufferPool *BufferPool) (err error) {
+	this.bufferPool = bufferPool
+
+	return nil
+}
+
+func (this *TCPRemote) Open() (err error) {
+
+	this.listener, err = net.Listen("tcp", this.addr)
+	if err != nil {
+		return err
+	}
+
+	this.log.Info("Waiting for Amiga", "addr", this.listener.Addr().String())
+
+	this.running.Store(true)
+	go this.acceptor(this.listener)
+	go this.writer()
+	return nil
+}
+
+func (this *TCPRemote) Close() {
+
+	if !this.running.CompareAndSwap(true, false) {
+		return
+	}
+
+	close(this.quitChan)
+
+	if this.listener != nil {
+		this.listener.Close()
+		this.listener = nil
+	}
+
+	this.setConn(nil)
+
+	this.ctrlChan <- true
+}
+
+func (this *TCPRemote) GetReadChan() (readChan chan []byte) {
+	return this.readChan
+}
+
+func (this *TCPRemote) GetLinkChan() (linkChan chan bool) {
+	return this.linkChan
+}
+
+func (this *TCPRemote) setLink(up bool) {
+
+	select {
+	case this.linkChan <- up:
+	default:
+		this.log.Warn("Link state not taken", "up", up)
+	}
+}
+
+func (this *TCPRemote) Write(data []byte) (err error) {
+
+	if this.closing() {
+		return ErrRemoteClosed
+	}
+
+	select {
+	case this.writeChan <- data:
+		return nil
+	case <-this.quitChan:
+		return ErrRemoteClosed
+	}
+}
+
+// Only one Amiga is served at a time, a new connection replaces the old one.
+func (this *TCPRemote) setConn(conn net.Conn) {
+
+	this.connLock.Lock()
+	defer this.connLock.Unlock()
+
+	if this.conn != nil {
+		this.conn.Close()
+	}
+	this.conn = conn
+}
+
+func (this *TCPRemote) getConn() net.Conn {
+
+	this.connLock.Lock()
+	defer this.connLock.Unlock()
+
+	return this.conn
+}
+
+// closing reports whether Close has been called.
+func (this *TCPRemote) closing() bool {
+
+	select {
+	case <-this.quitChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (this *TCPRemote) acceptor(l net.Listener) {
+
+	for {
+
+		conn, err := l.Accept()
+		if err != nil {
+			if !this.closing() {
+				this.log.Error("Accept failed", "err", err)
+			}
+			return
+		}
+
+		this.log.Info("Amiga connected", "addr", conn.RemoteAddr().String())
+
+		this.setConn(conn)
+		this.setLink(true)
+
+		go this.reader(conn)
+	}
+}
+
+func (this *TCPRemote) writer() {
+
+	for {
+		select {
+		case <-this.ctrlChan:
+			return
+		case buf := <-this.writeChan:
+			conn := this.getConn()
+			if conn == nil {
+				continue
+			}
+			if _, err := conn.Write(buf); err != nil {
+				this.log.Warn("Write failed", "err", err)
+			}
+		}
+	}
+}
+
+func (this *TCPRemote) reader(conn net.Conn) {
+
+	for !this.closing() {
+
+		buf := this.bufferPool.AllocBuffer()
+		bytesRead, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+
+		if bytesRead > 0 {
+
+			select {
+			case this.readChan <- buf[0:bytesRead]:
+			case <-this.quitChan:
+			}
+		}
+	}
+
+	this.log.Info("Amiga disconnected", "addr", conn.RemoteAddr().String())
+
+	// A connection that was replaced isn't a lost link, the new one
+	// starts a new session anyway.
+	this.connLock.Lock()
+	current := this.conn == conn
+	if current {
+		this.conn.Close()
+		this.conn = nil
+	}
+	this.connLock.Unlock()
+
+	if current && !this.closing() {
+		this.setLink(false)
+	}
+}
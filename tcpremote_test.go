@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpClient is the Amiga's end of a TCPRemote, an emulator in real life.
+type tcpClient struct {
+	addr       string
+	conn       net.Conn
+	bufferPool *BufferPool
+	readChan   chan []byte
+}
+
+func (this *tcpClient) Init(bufferPool *BufferPool) (err error) {
+	this.bufferPool = bufferPool
+	return nil
+}
+
+func (this *tcpClient) Open() (err error) {
+
+	// The server may not be listening yet.
+	for tries := 0; tries < 50; tries++ {
+		if this.conn, err = net.Dial("tcp", this.addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			buf := this.bufferPool.AllocBuffer()
+			n, err := this.conn.Read(buf)
+			if err != nil {
+				return
+			}
+			this.readChan <- buf[:n]
+		}
+	}()
+
+	return nil
+}
+
+func (this *tcpClient) Close() {
+	this.conn.Close()
+}
+
+func (this *tcpClient) GetReadChan() (readChan chan []byte) {
+	return this.readChan
+}
+
+func (this *tcpClient) Write(data []byte) (err error) {
+	_, err = this.conn.Write(data)
+	return err
+}
+
+func freeAddr(t *testing.T) string {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func TestTCPRemoteSession(t *testing.T) {
+
+	addr := freeAddr(t)
+	tr, _ := NewTCPRemote(addr)
+
+	hf := NewHandlerFactory()
+	hf.AddContextHandler(HT_Ping, "PING", NewPingHandler)
+	srv := NewServer(tr, hf)
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- srv.Run()
+	}()
+
+	amiga := NewFakeAmiga(&tcpClient{addr: addr, readChan: make(chan []byte, 10)})
+	if err := amiga.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := amiga.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := amiga.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close while the reader is still waiting on the Amiga.
+	srv.Stop()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+
+	amiga.Stop()
+}
+
+func TestTCPRemoteWriteAfterClose(t *testing.T) {
+
+	tr, _ := NewTCPRemote(freeAddr(t))
+	tr.Init(NewBufferPool(10))
+	if err := tr.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody is connected, the writer throws these away.
+	for ix := 0; ix < 10; ix++ {
+		if err := tr.Write([]byte{1, 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	closed := make(chan bool)
+	for ix := 0; ix < 2; ix++ {
+		go func() {
+			tr.Close()
+			closed <- true
+		}()
+	}
+	<-closed
+	<-closed
+
+	// More than the queue holds, none of it may block.
+	written := make(chan error)
+	go func() {
+		var err error
+		for ix := 0; ix < 200 && err == nil; ix++ {
+			err = tr.Write([]byte{1, 2})
+		}
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		if err != ErrRemoteClosed {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked after close")
+	}
+}
+
+// slowHandler takes a while to quit once its connection is closed.
+type slowHandler struct{}
+
+func (slowHandler) Serve(ctx context.Context, conn *HandlerConn) error {
+
+	<-ctx.Done()
+	time.Sleep(200 * time.Millisecond)
+
+	return nil
+}
+
+func TestTCPRemoteReconnect(t *testing.T) {
+
+	addr := freeAddr(t)
+	tr, _ := NewTCPRemote(addr)
+
+	hf := NewHandlerFactory()
+	hf.AddContextHandler(HT_Ping, "PING", NewPingHandler)
+	hf.AddContextHandler(9, "SLOW", func() ContextHandler { return slowHandler{} })
+	srv := NewServer(tr, hf)
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- srv.Run()
+	}()
+	defer func() {
+		srv.Stop()
+		<-stopped
+	}()
+
+	var amiga *FakeAmiga
+	for ix := 0; ix < 5; ix++ {
+		if amiga != nil {
+			// The server is busy closing the slow connection while the
+			// next Amiga connects and sends MT_Init at once, so the link
+			// coming up and the MT_Init are both waiting for it.
+			amiga.Stop()
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		amiga = NewFakeAmiga(&tcpClient{addr: addr, readChan: make(chan []byte, 10)})
+		amiga.WindowSize = 4
+		if err := amiga.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := amiga.Init(); err != nil {
+			t.Fatal(ix, err)
+		}
+		if err := amiga.Connect(3, HT_Ping); err != nil {
+			t.Fatal(ix, err)
+		}
+		if err := amiga.Connect(4, 9); err != nil {
+			t.Fatal(ix, err)
+		}
+	}
+
+	amiga.Stop()
+}
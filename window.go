@@ -0,0 +1,141 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	MaxWindowSize = 32
+	InitialRTO    = 1 * time.Second
+	MinRTO        = 200 * time.Millisecond
+	MaxRTO        = 10 * time.Second
+)
+
+// sendWindow tracks outgoing packets that the Amiga has not acknowledged
+// yet. A size of zero means the client does not acknowledge packets and
+// nothing is held back or retransmitted on a timer.
+type sendWindow struct {
+	size     uint16
+	inFlight []*OutPacket
+	pending  []*OutPacket
+	rto      time.Duration
+	srtt     time.Duration
+	rttvar   time.Duration
+}
+
+func newSendWindow(size uint16) *sendWindow {
+
+	return &sendWindow{
+		size:     size,
+		inFlight: make([]*OutPacket, 0, size),
+		pending:  make([]*OutPacket, 0),
+		rto:      InitialRTO}
+}
+
+func (this *sendWindow) enabled() bool {
+	return this.size > 0
+}
+
+// hasRoom reports whether another packet can be put on the line.
+func (this *sendWindow) hasRoom() bool {
+	return !this.enabled() || len(this.inFlight)+len(this.pending) < int(this.size)
+}
+
+func (this *sendWindow) canSend() bool {
+	return !this.enabled() || len(this.inFlight) < int(this.size)
+}
+
+func (this *sendWindow) queue(op *OutPacket) {
+	this.pending = append(this.pending, op)
+}
+
+// nextPending removes and returns the oldest queued packet, if it may be sent.
+func (this *sendWindow) nextPending() *OutPacket {
+
+	if len(this.pending) == 0 || !this.canSend() {
+		return nil
+	}
+
+	op := this.pending[0]
+	this.pending = this.pending[1:]
+	return op
+}
+
+func (this *sendWindow) sent(op *OutPacket, now time.Time) {
+
+	op.SentAt = now
+	if this.enabled() {
+		this.inFlight = append(this.inFlight, op)
+	}
+}
+
+// ack drops every in flight packet up to and including packId and
+// returns them.
+func (this *sendWindow) ack(packId uint16, now time.Time) (acked []*OutPacket) {
+
+	count := 0
+	for count < len(this.inFlight) {
+		op := this.inFlight[count]
+		if seqDiff(packId, op.PackId) < 0 {
+			break
+		}
+
+		// Karn's algorithm, only time packets that were sent once.
+		if op.Retries == 0 {
+			this.updateRTO(now.Sub(op.SentAt))
+		}
+		count++
+	}
+
+	acked = this.inFlight[:count]
+	this.inFlight = this.inFlight[count:]
+
+	return acked
+}
+
+func (this *sendWindow) updateRTO(rtt time.Duration) {
+
+	if this.srtt == 0 {
+		this.srtt = rtt
+		this.rttvar = rtt / 2
+	} else {
+		diff := this.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		this.rttvar = (3*this.rttvar + diff) / 4
+		this.srtt = (7*this.srtt + rtt) / 8
+	}
+
+	this.rto = this.srtt + 4*this.rttvar
+	this.clampRTO()
+}
+
+func (this *sendWindow) clampRTO() {
+	if this.rto < MinRTO {
+		this.rto = MinRTO
+	} else if this.rto > MaxRTO {
+		this.rto = MaxRTO
+	}
+}
+
+// expired returns the oldest in flight packet if its timer has run out,
+// backing off the timeout for the next attempt.
+func (this *sendWindow) expired(now time.Time) *OutPacket {
+
+	if len(this.inFlight) == 0 {
+		return nil
+	}
+
+	op := this.inFlight[0]
+	if now.Sub(op.SentAt) < this.rto {
+		return nil
+	}
+
+	op.Retries++
+	op.SentAt = now
+	this.rto *= 2
+	this.clampRTO()
+
+	return op
+}
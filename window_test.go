@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// sendAt puts a packet with id on the line at now.
+func sendAt(w *sendWindow, id uint16, now time.Time) *OutPacket {
+
+	op := &OutPacket{PackId: id}
+	w.sent(op, now)
+	return op
+}
+
+func TestWindowRTO(t *testing.T) {
+
+	start := time.Now()
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+
+	tests := []struct {
+		rtts []int
+		rto  time.Duration
+	}{
+		// The first sample sets the variance to half of it.
+		{[]int{100}, ms(300)},
+		{[]int{100, 100}, ms(250)},
+		// srtt 7/8 of 100 and 1/8 of 300, rttvar 3/4 of 50 and 1/4 of 200.
+		{[]int{100, 300}, ms(125 + 4*87.5)},
+		// Never below MinRTO or above MaxRTO.
+		{[]int{10}, MinRTO},
+		{[]int{5000}, MaxRTO}}
+
+	for _, test := range tests {
+		w := newSendWindow(8)
+		now := start
+		for ix, rtt := range test.rtts {
+			sendAt(w, uint16(ix+1), now)
+			now = now.Add(ms(rtt))
+			if acked := w.ack(uint16(ix+1), now); len(acked) != 1 {
+				t.Fatalf("%v: %d packets acked", test.rtts, len(acked))
+			}
+		}
+		if w.rto != test.rto {
+			t.Errorf("%v: rto %v, want %v", test.rtts, w.rto, test.rto)
+		}
+	}
+}
+
+func TestWindowBackoff(t *testing.T) {
+
+	start := time.Now()
+	w := newSendWindow(8)
+	op := sendAt(w, 1, start)
+
+	if w.expired(start.Add(InitialRTO-time.Millisecond)) != nil {
+		t.Fatal("expired before the timeout")
+	}
+
+	// Every timeout doubles the next one, up to MaxRTO.
+	now := start
+	for _, want := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, MaxRTO, MaxRTO} {
+		now = now.Add(w.rto)
+		if w.expired(now) != op {
+			t.Fatal("not expired after", now.Sub(start))
+		}
+		if w.rto != want {
+			t.Fatalf("after %d retries: rto %v, want %v", op.Retries, w.rto, want)
+		}
+		if op.SentAt != now {
+			t.Fatal("timer not restarted")
+		}
+	}
+
+	// Karn's algorithm, the ack may be for any of the copies, so it says
+	// nothing about the round trip.
+	if acked := w.ack(1, now.Add(50*time.Millisecond)); len(acked) != 1 {
+		t.Fatalf("%d packets acked", len(acked))
+	}
+	if w.rto != MaxRTO || w.srtt != 0 {
+		t.Fatalf("retransmitted packet timed, rto %v srtt %v", w.rto, w.srtt)
+	}
+
+	// A packet sent once is timed.
+	sendAt(w, 2, now)
+	w.ack(2, now.Add(100*time.Millisecond))
+	if w.srtt != 100*time.Millisecond || w.rto != 300*time.Millisecond {
+		t.Fatalf("rto %v srtt %v", w.rto, w.srtt)
+	}
+}
+
+func TestWindowAck(t *testing.T) {
+
+	now := time.Now()
+	w := newSendWindow(3)
+
+	// Ids wrap around.
+	for _, id := range []uint16{0xfffe, 0xffff, 0} {
+		if !w.canSend() {
+			t.Fatal("window full early")
+		}
+		sendAt(w, id, now)
+	}
+	if w.canSend() || w.hasRoom() {
+		t.Fatal("window not full")
+	}
+
+	w.queue(&OutPacket{PackId: 1})
+	if w.nextPending() != nil {
+		t.Fatal("pending packet let through a full window")
+	}
+
+	// Acks are cumulative, an old one changes nothing.
+	if acked := w.ack(0xfffd, now); len(acked) != 0 {
+		t.Fatalf("old ack took %d packets", len(acked))
+	}
+	if acked := w.ack(0xffff, now); len(acked) != 2 || acked[0].PackId != 0xfffe || acked[1].PackId != 0xffff {
+		t.Fatalf("acked %v", acked)
+	}
+
+	op := w.nextPending()
+	if op == nil || op.PackId != 1 || w.nextPending() != nil {
+		t.Fatal("pending packet not released")
+	}
+
+	// Without a window nothing is held back or timed.
+	w = newSendWindow(0)
+	sendAt(w, 1, now)
+	if !w.canSend() || !w.hasRoom() || w.expired(now.Add(MaxRTO)) != nil {
+		t.Fatal("disabled window held packets")
+	}
+}